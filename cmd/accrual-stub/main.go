@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/accrual/stub"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/configuration"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+const defaultAddress = "localhost:8081"
+
+var (
+	flAddress   = flag.String("a", "", "Stub's address, "+defaultAddress+" by default")      // ACCRUAL_STUB_ADDRESS
+	flScript    = flag.String("script", "", "JSON file with scripted responses")             // ACCRUAL_STUB_SCRIPT
+	flLatency   = flag.Duration("latency", 0, "Delay added to every response")               // ACCRUAL_STUB_LATENCY
+	flRateLimit = flag.Int("rate-limit", 0, "Requests per minute before answering with 429") // ACCRUAL_STUB_RATE_LIMIT
+)
+
+func main() {
+	flag.Parse()
+
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run() error {
+	address := configuration.ParseOptionalStringVar(flAddress, "ACCRUAL_STUB_ADDRESS")
+	if address == "" {
+		address = defaultAddress
+	}
+
+	script := configuration.ParseOptionalStringVar(flScript, "ACCRUAL_STUB_SCRIPT")
+
+	latency, err := configuration.ParseDurationVar(flLatency, "ACCRUAL_STUB_LATENCY", 0)
+	if err != nil {
+		return err
+	}
+
+	rateLimit, err := configuration.ParseIntVar(flRateLimit, "ACCRUAL_STUB_RATE_LIMIT")
+	if err != nil {
+		return err
+	}
+
+	server := stub.NewServer()
+	server.SetLatency(latency)
+	server.SetRateLimit(rateLimit)
+
+	if script != "" {
+		file, err := os.Open(script)
+		if err != nil {
+			return err
+		}
+
+		err = server.LoadScript(file)
+		if closeErr := file.Close(); closeErr != nil {
+			log.Println(closeErr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+	srv := &http.Server{
+		Addr:    address,
+		Handler: server.Handler(),
+	}
+
+	go func() {
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	log.Println("Accrual stub is listening on", address)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+
+	sig := <-signals
+	log.Println("Got signal:", sig.String())
+
+	return srv.Shutdown(context.Background())
+}
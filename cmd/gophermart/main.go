@@ -4,29 +4,107 @@ import (
 	"errors"
 	"flag"
 	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/configuration"
-	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/worker"
 	"golang.org/x/net/context"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
+)
+
+const (
+	purgeInterval   = time.Hour
+	shutdownTimeout = 10 * time.Second
+	drainTimeout    = 10 * time.Second
 )
 
 var (
-	flAddress    = flag.String("a", "", "Gophermart's address") // RUN_ADDRESS
-	flDsn        = flag.String("d", "", "Database dsn")         // DATABASE_URI
-	flAccAddress = flag.String("r", "", "Accrual's address")    // ACCRUAL_SYSTEM_ADDRESS
+	flAddress    = flag.String("a", "", "Gophermart's address")                        // RUN_ADDRESS
+	flDsn        = flag.String("d", "", "Database dsn")                                // DATABASE_URI
+	flAccAddress = flag.String("r", "", "Accrual's address")                           // ACCRUAL_SYSTEM_ADDRESS
+	flStorage    = flag.String("storage", "", "Storage backend: postgres or memory")   // STORAGE
+	flConfig     = flag.String("config", "", "JSON config file with accrual settings") // CONFIG
+
+	flAccPath      = flag.String("accrual-path", "", "Path of the accrual system's orders endpoint")   // ACCRUAL_PATH
+	flAccTimeout   = flag.Duration("accrual-timeout", 0, "Timeout of a request to the accrual system") // ACCRUAL_TIMEOUT
+	flWorkers      = flag.Int("accrual-workers", 0, "Concurrent requests to the accrual system")       // ACCRUAL_WORKERS
+	flPollInterval = flag.Duration("accrual-poll-interval", 0, "How often due orders are leased")      // ACCRUAL_POLL_INTERVAL
+	flMaxInFlight  = flag.Int("accrual-max-in-flight", 0, "Leased orders waiting for a poll at most")  // ACCRUAL_MAX_IN_FLIGHT
+
+	flGiveUpAfter = flag.Duration("accrual-give-up-after", 0, "How long to poll orders unknown to the accrual system") // ACCRUAL_GIVE_UP_AFTER
+	flBackoffBase = flag.Duration("accrual-backoff-base", 0, "Delay after the first poll of an order")                 // ACCRUAL_BACKOFF_BASE
+	flBackoffMax  = flag.Duration("accrual-backoff-max", 0, "Maximum delay between polls of an order")                 // ACCRUAL_BACKOFF_MAX
+	flBatchSize   = flag.Int("accrual-batch-size", 0, "Due orders leased per polling tick")                            // ACCRUAL_BATCH_SIZE
+
+	flDBMinConns     = flag.Int("db-min-conns", 0, "Minimum number of database connections")                   // DATABASE_MIN_CONNS
+	flDBMaxConns     = flag.Int("db-max-conns", 0, "Maximum number of database connections")                   // DATABASE_MAX_CONNS
+	flRequestTimeout = flag.Duration("request-timeout", 0, "HTTP request processing timeout")                  // REQUEST_TIMEOUT
+	flTrustedProxies = flag.String("trusted-proxies", "", "Proxy IPs or CIDRs trusted to set X-Forwarded-For") // TRUSTED_PROXIES
+
+	flTokenTTL      = flag.Duration("token-ttl", 0, "Access token lifetime")                           // TOKEN_TTL
+	flRefreshTTL    = flag.Duration("refresh-token-ttl", 0, "Refresh token lifetime")                  // REFRESH_TOKEN_TTL
+	flTokenKeys     = flag.String("token-keys", "", "Token keys as kid:secret pairs, first one signs") // TOKEN_KEYS
+	flTokenKeysFile = flag.String("token-keys-file", "", "File with kid:secret token keys")            // TOKEN_KEYS_FILE
+
+	flAuthCookie         = flag.Bool("auth-cookie", false, "Enable cookie based browser sessions")           // AUTH_COOKIE
+	flAuthCookieInsecure = flag.Bool("auth-cookie-insecure", false, "Allow session cookies over plain HTTP") // AUTH_COOKIE_INSECURE
+
+	flLoginPattern       = flag.String("login-pattern", "", "Regular expression allowed logins must match")   // LOGIN_PATTERN
+	flPasswordMinLength  = flag.Int("password-min-length", 0, "Minimum password length")                      // PASSWORD_MIN_LENGTH
+	flPasswordMinClasses = flag.Int("password-min-classes", 0, "Minimum number of character classes")         // PASSWORD_MIN_CLASSES
+	flPasswordDenylist   = flag.String("password-denylist", "", "File with breached passwords, one per line") // PASSWORD_DENYLIST_FILE
 )
 
 func main() {
 	flag.Parse()
 
-	config, err := configuration.NewConfiguration(flAddress, flDsn, flAccAddress)
+	switch flag.Arg(0) {
+	case "migrate":
+		os.Exit(runMigrate(flag.Args()[1:]))
+	case "reconcile":
+		os.Exit(runReconcile(flag.Args()[1:]))
+	}
+
+	config, err := configuration.NewConfiguration(configuration.Flags{
+		Address:        flAddress,
+		Dsn:            flDsn,
+		AccAddress:     flAccAddress,
+		Storage:        flStorage,
+		Config:         flConfig,
+		AccPath:        flAccPath,
+		AccTimeout:     flAccTimeout,
+		Workers:        flWorkers,
+		PollInterval:   flPollInterval,
+		MaxInFlight:    flMaxInFlight,
+		GiveUpAfter:    flGiveUpAfter,
+		BackoffBase:    flBackoffBase,
+		BackoffMax:     flBackoffMax,
+		BatchSize:      flBatchSize,
+		DBMinConns:     flDBMinConns,
+		DBMaxConns:     flDBMaxConns,
+		RequestTimeout: flRequestTimeout,
+		TrustedProxies: flTrustedProxies,
+		TokenTTL:       flTokenTTL,
+		RefreshTTL:     flRefreshTTL,
+		TokenKeys:      flTokenKeys,
+		TokenKeysFile:  flTokenKeysFile,
+
+		AuthCookie:         flAuthCookie,
+		AuthCookieInsecure: flAuthCookieInsecure,
+
+		LoginPattern:       flLoginPattern,
+		PasswordMinLength:  flPasswordMinLength,
+		PasswordMinClasses: flPasswordMinClasses,
+		PasswordDenylist:   flPasswordDenylist,
+	})
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	defer config.Close()
+
+	log.Println("Configuration:", config)
 
 	go func() {
 		if err := config.Server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
@@ -37,14 +115,59 @@ func main() {
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
 
-	wp := worker.NewWorkerPool(8, config.AccAddress+"/api/orders/", config.Storage)
-	wp.Run()
-	defer wp.Stop()
+	config.Pool.Run(context.Background())
+
+	janitor := time.NewTicker(purgeInterval)
+	defer janitor.Stop()
+	go purgeExpired(config.Storage, janitor.C)
 
 	sig := <-signals
 
 	log.Println("Got signal:", sig.String())
-	if err := config.Server.Shutdown(context.Background()); err != nil {
+
+	// the server goes first so that no new orders arrive, the database is closed by the deferred Close
+	// once the workers have saved their last polls
+	serverCtx, serverCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer serverCancel()
+	if err := config.Server.Shutdown(serverCtx); err != nil {
 		log.Println("HTTP server Shutdown:", err)
 	}
+
+	poolCtx, poolCancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer poolCancel()
+	if err := config.Pool.Shutdown(poolCtx); err != nil {
+		log.Println("Worker pool Shutdown:", err)
+	}
+}
+
+type purger interface {
+	DeleteExpiredIdempotencyKeys(ctx context.Context) (int64, error)
+	DeleteExpiredTokens(ctx context.Context) (int64, error)
+	DeleteExpiredLoginAttempts(ctx context.Context) (int64, error)
+}
+
+// purgeExpired removes expired idempotency records, revoked or expired tokens and stale login counters.
+func purgeExpired(storage purger, ticks <-chan time.Time) {
+	for range ticks {
+		deleted, err := storage.DeleteExpiredIdempotencyKeys(context.Background())
+		if err != nil {
+			log.Println(err)
+		} else if deleted > 0 {
+			log.Printf("Purged %d expired idempotency keys", deleted)
+		}
+
+		deleted, err = storage.DeleteExpiredTokens(context.Background())
+		if err != nil {
+			log.Println(err)
+		} else if deleted > 0 {
+			log.Printf("Purged %d expired tokens", deleted)
+		}
+
+		deleted, err = storage.DeleteExpiredLoginAttempts(context.Background())
+		if err != nil {
+			log.Println(err)
+		} else if deleted > 0 {
+			log.Printf("Purged %d stale login attempt counters", deleted)
+		}
+	}
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/configuration"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/repository/postgre"
+	"log"
+	"time"
+)
+
+// runMigrate handles `gophermart migrate up|down|status`.
+func runMigrate(args []string) int {
+	if len(args) == 0 {
+		log.Println("Usage: gophermart migrate up|down [-steps N]|status")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("migrate "+args[0], flag.ContinueOnError)
+	steps := fs.Int("steps", 1, "Number of migrations to roll back")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	pool, err := configuration.NewDB(context.Background(), flDsn)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer pool.Close()
+
+	migrator, err := postgre.NewMigrator(pool)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(context.Background())
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		log.Printf("Applied %d migrations", applied)
+	case "down":
+		rolledBack, err := migrator.Down(context.Background(), *steps)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		log.Printf("Rolled back %d migrations", rolledBack)
+	case "status":
+		statuses, err := migrator.Status(context.Background())
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		for _, status := range statuses {
+			if status.AppliedAt == nil {
+				log.Printf("%04d_%s: pending", status.Version, status.Name)
+				continue
+			}
+			log.Printf("%04d_%s: applied at %s", status.Version, status.Name, status.AppliedAt.Format(time.RFC3339))
+		}
+	default:
+		log.Printf("Unknown migrate command: %s", args[0])
+		return 2
+	}
+
+	return 0
+}
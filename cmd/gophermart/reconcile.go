@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/configuration"
+	"log"
+)
+
+// runReconcile recomputes balances from history and reports users whose ledger drifted.
+func runReconcile(args []string) int {
+	fs := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	fix := fs.Bool("fix", false, "Overwrite mismatching balances with recomputed values")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	storage, pool, err := configuration.NewStorage(context.Background(), flDsn)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer pool.Close()
+
+	mismatches, err := storage.Reconcile(context.Background(), *fix)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	for _, m := range mismatches {
+		log.Printf(
+			"Balance mismatch for %s: stored current=%v withdrawn=%v, expected current=%v withdrawn=%v",
+			m.Login, m.Stored.Current, m.Stored.Withdrawn, m.Expected.Current, m.Expected.Withdrawn,
+		)
+	}
+
+	log.Printf("Reconciliation finished: %d mismatches found", len(mismatches))
+	if len(mismatches) > 0 && !*fix {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/configuration"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/model"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/testdb"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestRunReconcile(t *testing.T) {
+	dsn := testdb.DSN(t)
+
+	prev := *flDsn
+	*flDsn = dsn
+	t.Cleanup(func() { *flDsn = prev })
+
+	ctx := context.Background()
+	storage, pool, err := configuration.NewStorage(ctx, flDsn)
+	require.NoError(t, err)
+	defer pool.Close()
+
+	accrual := model.Money(10000)
+	require.NoError(t, storage.Create(ctx, model.User{Login: "gopher", Password: "secret"}))
+	require.NoError(t, storage.UpdateOrder(ctx, "gopher", model.Order{Number: "79927398713"}))
+	require.NoError(t, storage.UpdateOrder(ctx, "gopher", model.Order{Number: "79927398713", Status: model.OrderStatusProcessed, Accrual: &accrual}))
+
+	require.Equal(t, 0, runReconcile(nil))
+
+	_, err = pool.Exec(ctx, `UPDATE balances SET current = current - 100 WHERE login = 'gopher'`)
+	require.NoError(t, err)
+
+	// a mismatch fails the run until it's fixed
+	require.Equal(t, 1, runReconcile(nil))
+	require.Equal(t, 1, runReconcile(nil))
+	require.Equal(t, 0, runReconcile([]string{"-fix"}))
+	require.Equal(t, 0, runReconcile(nil))
+
+	bal, err := storage.GetBalance(ctx, "gopher")
+	require.NoError(t, err)
+	require.Equal(t, model.Balance{Current: 10000}, bal)
+
+	require.Equal(t, 2, runReconcile([]string{"-unknown"}))
+}
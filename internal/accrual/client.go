@@ -0,0 +1,216 @@
+// Package accrual is a client of the accrual system that calculates loyalty points for orders.
+package accrual
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/model"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Statuses of an order in the accrual system.
+const (
+	StatusRegistered = "REGISTERED"
+	StatusProcessing = "PROCESSING"
+	StatusInvalid    = "INVALID"
+	StatusProcessed  = "PROCESSED"
+)
+
+const (
+	DefaultTimeout    = 5 * time.Second
+	DefaultPath       = "/api/orders/"
+	defaultRetryAfter = 60 * time.Second
+	maxBodySize       = 1 << 20
+)
+
+var (
+	ErrorOrderNotRegistered = errors.New("error: order isn't registered in the accrual system")
+	ErrorUnavailable        = errors.New("error: accrual system is unavailable")
+	ErrorUnexpectedResponse = errors.New("error: unexpected accrual system response")
+)
+
+var rateLimitRe = regexp.MustCompile(`No more than (\d+) requests per minute allowed`)
+
+// OrderAccrual is the accrual system's view of an order.
+type OrderAccrual struct {
+	Order   string       `json:"order"`
+	Status  string       `json:"status"`
+	Accrual *model.Money `json:"accrual,omitempty"`
+}
+
+// TooManyRequestsError is returned on 429, RequestsPerMinute is zero when the body didn't name the limit.
+type TooManyRequestsError struct {
+	RetryAfter        time.Duration
+	RequestsPerMinute int
+}
+
+func (e *TooManyRequestsError) Error() string {
+	return fmt.Sprintf("error: accrual system is throttling requests, retry after %s", e.RetryAfter)
+}
+
+// Metrics is notified about every request, status is zero when there was no response at all.
+type Metrics interface {
+	ObserveRequest(status int, elapsed time.Duration)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) ObserveRequest(int, time.Duration) {}
+
+type Client struct {
+	base    *url.URL
+	path    string
+	client  *http.Client
+	timeout time.Duration
+	metrics Metrics
+	now     func() time.Time
+}
+
+// NewClient returns a client of the accrual system at address, orders are asked for under path.
+// An empty path means DefaultPath, a nil httpClient means http.DefaultClient, a zero timeout
+// means DefaultTimeout and metrics may be nil.
+func NewClient(address, path string, httpClient *http.Client, timeout time.Duration, metrics Metrics) (*Client, error) {
+	base, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if base.Scheme != "http" && base.Scheme != "https" || base.Host == "" {
+		return nil, fmt.Errorf("error: accrual system address %q must be an absolute http(s) URL", address)
+	}
+
+	if path == "" {
+		path = DefaultPath
+	}
+
+	if ref, err := url.Parse(path); err != nil || ref.Scheme != "" || ref.Host != "" || ref.RawQuery != "" || ref.Fragment != "" {
+		return nil, fmt.Errorf("error: accrual orders path %q must be a plain URL path", path)
+	}
+
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	if metrics == nil {
+		metrics = nopMetrics{}
+	}
+
+	return &Client{
+		base:    base,
+		path:    path,
+		client:  httpClient,
+		timeout: timeout,
+		metrics: metrics,
+		now:     time.Now,
+	}, nil
+}
+
+// GetOrder asks for the accrual of an order. It returns ErrorOrderNotRegistered on 204,
+// *TooManyRequestsError on 429 and ErrorUnavailable on 5xx and transport failures.
+func (c *Client) GetOrder(ctx context.Context, number string) (OrderAccrual, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.base.JoinPath(c.path, number).String(), nil)
+	if err != nil {
+		return OrderAccrual{}, err
+	}
+
+	start := c.now()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.metrics.ObserveRequest(0, c.now().Sub(start))
+		return OrderAccrual{}, fmt.Errorf("%w: %w", ErrorUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	c.metrics.ObserveRequest(resp.StatusCode, c.now().Sub(start))
+	if err != nil {
+		return OrderAccrual{}, fmt.Errorf("%w: %w", ErrorUnavailable, err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return decodeOrder(number, body)
+	case resp.StatusCode == http.StatusNoContent:
+		return OrderAccrual{}, ErrorOrderNotRegistered
+	case resp.StatusCode == http.StatusTooManyRequests:
+		limit, _ := parseRateLimit(body)
+		return OrderAccrual{}, &TooManyRequestsError{
+			RetryAfter:        parseRetryAfter(resp.Header.Get("Retry-After"), c.now()),
+			RequestsPerMinute: limit,
+		}
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return OrderAccrual{}, fmt.Errorf("%w: got status code %d", ErrorUnavailable, resp.StatusCode)
+	default:
+		return OrderAccrual{}, fmt.Errorf("%w: got status code %d", ErrorUnexpectedResponse, resp.StatusCode)
+	}
+}
+
+func decodeOrder(number string, body []byte) (OrderAccrual, error) {
+	var order OrderAccrual
+	err := json.Unmarshal(body, &order)
+	if err != nil {
+		return OrderAccrual{}, fmt.Errorf("%w: %w", ErrorUnexpectedResponse, err)
+	}
+
+	if order.Order != number {
+		return OrderAccrual{}, fmt.Errorf("%w: asked for order %s, got %q", ErrorUnexpectedResponse, number, order.Order)
+	}
+
+	switch order.Status {
+	case StatusRegistered, StatusProcessing, StatusInvalid, StatusProcessed:
+	default:
+		return OrderAccrual{}, fmt.Errorf("%w: unknown status %q", ErrorUnexpectedResponse, order.Status)
+	}
+
+	return order, nil
+}
+
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return defaultRetryAfter
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return defaultRetryAfter
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		if d := date.Sub(now); d > 0 {
+			return d
+		}
+		return 0
+	}
+
+	return defaultRetryAfter
+}
+
+func parseRateLimit(body []byte) (int, bool) {
+	match := rateLimitRe.FindSubmatch(body)
+	if match == nil {
+		return 0, false
+	}
+
+	limit, err := strconv.Atoi(string(match[1]))
+	if err != nil || limit <= 0 {
+		return 0, false
+	}
+
+	return limit, true
+}
@@ -0,0 +1,267 @@
+package accrual
+
+import (
+	"context"
+	"errors"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/model"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type countingMetrics struct {
+	statuses []int
+}
+
+func (m *countingMetrics) ObserveRequest(status int, _ time.Duration) {
+	m.statuses = append(m.statuses, status)
+}
+
+func TestClient_GetOrder(t *testing.T) {
+	accrual := model.Money(50050)
+
+	tests := []struct {
+		name    string
+		status  int
+		header  map[string]string
+		body    string
+		want    OrderAccrual
+		wantErr error
+		check   func(t *testing.T, err error)
+	}{
+		{
+			name:   "processed",
+			status: http.StatusOK,
+			body:   `{"order":"79927398713","status":"PROCESSED","accrual":500.5}`,
+			want:   OrderAccrual{Order: "79927398713", Status: StatusProcessed, Accrual: &accrual},
+		},
+		{
+			name:   "registered",
+			status: http.StatusOK,
+			body:   `{"order":"79927398713","status":"REGISTERED"}`,
+			want:   OrderAccrual{Order: "79927398713", Status: StatusRegistered},
+		},
+		{
+			name:    "not_registered",
+			status:  http.StatusNoContent,
+			wantErr: ErrorOrderNotRegistered,
+		},
+		{
+			name:   "too_many_requests",
+			status: http.StatusTooManyRequests,
+			header: map[string]string{"Retry-After": "30"},
+			body:   "No more than 60 requests per minute allowed",
+			check: func(t *testing.T, err error) {
+				var tooMany *TooManyRequestsError
+				require.True(t, errors.As(err, &tooMany))
+				require.Equal(t, &TooManyRequestsError{RetryAfter: 30 * time.Second, RequestsPerMinute: 60}, tooMany)
+			},
+		},
+		{
+			name:    "server_error",
+			status:  http.StatusInternalServerError,
+			wantErr: ErrorUnavailable,
+		},
+		{
+			name:    "unexpected_status",
+			status:  http.StatusNotFound,
+			wantErr: ErrorUnexpectedResponse,
+		},
+		{
+			name:    "malformed_body",
+			status:  http.StatusOK,
+			body:    `{"order":`,
+			wantErr: ErrorUnexpectedResponse,
+		},
+		{
+			name:    "other_order",
+			status:  http.StatusOK,
+			body:    `{"order":"1","status":"PROCESSED"}`,
+			wantErr: ErrorUnexpectedResponse,
+		},
+		{
+			name:    "unknown_status",
+			status:  http.StatusOK,
+			body:    `{"order":"79927398713","status":"DONE"}`,
+			wantErr: ErrorUnexpectedResponse,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				require.Equal(t, "/api/orders/79927398713", r.URL.Path)
+				for k, v := range tt.header {
+					w.Header().Set(k, v)
+				}
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			metrics := &countingMetrics{}
+			client, err := NewClient(srv.URL, "", srv.Client(), time.Second, metrics)
+			require.NoError(t, err)
+
+			got, err := client.GetOrder(context.Background(), "79927398713")
+			require.Equal(t, []int{tt.status}, metrics.statuses)
+
+			switch {
+			case tt.check != nil:
+				tt.check(t, err)
+			case tt.wantErr != nil:
+				require.ErrorIs(t, err, tt.wantErr)
+			default:
+				require.NoError(t, err)
+				require.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestClient_GetOrderTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	metrics := &countingMetrics{}
+	client, err := NewClient(srv.URL, "", srv.Client(), 20*time.Millisecond, metrics)
+	require.NoError(t, err)
+
+	_, err = client.GetOrder(context.Background(), "79927398713")
+	require.ErrorIs(t, err, ErrorUnavailable)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, []int{0}, metrics.statuses)
+}
+
+func TestNewClient(t *testing.T) {
+	for _, address := range []string{"localhost:8080", "/api", "ftp://accrual"} {
+		_, err := NewClient(address, "", nil, 0, nil)
+		require.Error(t, err, address)
+	}
+
+	for _, path := range []string{"http://accrual/api/orders", "//accrual/api/orders", "/api/orders?v=2"} {
+		_, err := NewClient("http://localhost:8080", path, nil, 0, nil)
+		require.Error(t, err, path)
+	}
+
+	_, err := NewClient("http://localhost:8080", "", nil, 0, nil)
+	require.NoError(t, err)
+}
+
+func TestClient_GetOrderPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		path    string
+		want    string
+	}{
+		{
+			name: "default",
+			want: "/api/orders/79927398713",
+		},
+		{
+			name: "custom",
+			path: "/v2/accruals",
+			want: "/v2/accruals/79927398713",
+		},
+		{
+			name:    "behind a prefix",
+			address: "/accrual/",
+			path:    "api/orders/",
+			want:    "/accrual/api/orders/79927398713",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.URL.Path
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer srv.Close()
+
+			client, err := NewClient(srv.URL+tt.address, tt.path, srv.Client(), time.Second, nil)
+			require.NoError(t, err)
+
+			_, err = client.GetOrder(context.Background(), "79927398713")
+			require.ErrorIs(t, err, ErrorOrderNotRegistered)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		value string
+		want  time.Duration
+	}{
+		{
+			name:  "seconds",
+			value: "60",
+			want:  60 * time.Second,
+		},
+		{
+			name:  "http_date",
+			value: "Mon, 01 May 2023 12:00:30 GMT",
+			want:  30 * time.Second,
+		},
+		{
+			name:  "date_in_past",
+			value: "Mon, 01 May 2023 11:00:00 GMT",
+			want:  0,
+		},
+		{
+			name:  "empty",
+			value: "",
+			want:  defaultRetryAfter,
+		},
+		{
+			name:  "garbage",
+			value: "soon",
+			want:  defaultRetryAfter,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, parseRetryAfter(tt.value, now))
+		})
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		limit int
+		ok    bool
+	}{
+		{
+			name:  "spec_body",
+			body:  "No more than 60 requests per minute allowed",
+			limit: 60,
+			ok:    true,
+		},
+		{
+			name: "zero",
+			body: "No more than 0 requests per minute allowed",
+		},
+		{
+			name: "unknown_body",
+			body: "slow down",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limit, ok := parseRateLimit([]byte(tt.body))
+			require.Equal(t, tt.ok, ok)
+			require.Equal(t, tt.limit, limit)
+		})
+	}
+}
@@ -0,0 +1,319 @@
+// Package stub is a scriptable stand-in for the accrual system, so the order lifecycle
+// can be tested without the real service.
+package stub
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/accrual"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/model"
+	"github.com/gin-gonic/gin"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultRetryAfter = 60 * time.Second
+
+// Response is a single scripted answer to GET /api/orders/{number}.
+// A zero Code means 200 with the status and accrual in the body.
+type Response struct {
+	Status     string
+	Accrual    *model.Money
+	Code       int
+	RetryAfter time.Duration // sent with 429, defaults to a minute
+	Delay      time.Duration
+}
+
+func Registered() Response {
+	return Response{Status: accrual.StatusRegistered}
+}
+
+func Processing() Response {
+	return Response{Status: accrual.StatusProcessing}
+}
+
+func Invalid() Response {
+	return Response{Status: accrual.StatusInvalid}
+}
+
+func Processed(points model.Money) Response {
+	return Response{Status: accrual.StatusProcessed, Accrual: &points}
+}
+
+func NotRegistered() Response {
+	return Response{Code: http.StatusNoContent}
+}
+
+func TooManyRequests(retryAfter time.Duration) Response {
+	return Response{Code: http.StatusTooManyRequests, RetryAfter: retryAfter}
+}
+
+func Failure(code int) Response {
+	return Response{Code: code}
+}
+
+// Server answers every order with its script, one response per request. The last response
+// of a script is repeated once the script is exhausted, orders without a script get
+// the default script, and 204 when there is none.
+type Server struct {
+	mu        sync.Mutex
+	scripts   map[string][]Response
+	fallback  []Response
+	position  map[string]int
+	served    map[string]int
+	injected  []Response
+	latency   time.Duration
+	rateLimit int
+	window    time.Time
+	inWindow  int
+	now       func() time.Time
+}
+
+func NewServer() *Server {
+	return &Server{
+		scripts:  make(map[string][]Response),
+		position: make(map[string]int),
+		served:   make(map[string]int),
+		now:      time.Now,
+	}
+}
+
+// Script replaces the responses for an order and restarts it from the first one.
+func (s *Server) Script(number string, responses ...Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.scripts[number] = append([]Response(nil), responses...)
+	delete(s.position, number)
+	delete(s.served, number)
+}
+
+// Default sets the script of orders that have none of their own.
+func (s *Server) Default(responses ...Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fallback = append([]Response(nil), responses...)
+}
+
+// Inject makes the next requests, whatever the order, get the given responses
+// before any script. Scripts resume where they were afterwards.
+func (s *Server) Inject(responses ...Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.injected = append(s.injected, responses...)
+}
+
+// SetLatency delays every response on top of the delay of the response itself.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.latency = d
+}
+
+// SetRateLimit answers 429 to requests above the limit per minute, zero disables the limit.
+func (s *Server) SetRateLimit(requestsPerMinute int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rateLimit = requestsPerMinute
+	s.window = time.Time{}
+	s.inWindow = 0
+}
+
+// Requests returns how many times the order has been asked for since it was scripted.
+func (s *Server) Requests(number string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.served[number]
+}
+
+// next picks the response to the request and returns the rate limit to report with a 429.
+func (s *Server) next(number string) (Response, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.served[number]++
+
+	now := s.now()
+	if s.rateLimit > 0 {
+		if now.Sub(s.window) >= time.Minute {
+			s.window = now
+			s.inWindow = 0
+		}
+
+		s.inWindow++
+		if s.inWindow > s.rateLimit {
+			resp := TooManyRequests(s.window.Add(time.Minute).Sub(now))
+			resp.Delay = s.latency
+			return resp, s.rateLimit
+		}
+	}
+
+	var resp Response
+	switch script, ok := s.scripts[number]; {
+	case len(s.injected) > 0:
+		resp = s.injected[0]
+		s.injected = s.injected[1:]
+	case ok && len(script) > 0:
+		resp = pick(script, s.position[number])
+		s.position[number]++
+	case !ok && len(s.fallback) > 0:
+		resp = pick(s.fallback, s.position[number])
+		s.position[number]++
+	default:
+		resp = NotRegistered()
+	}
+
+	resp.Delay += s.latency
+	return resp, s.rateLimit
+}
+
+func pick(script []Response, served int) Response {
+	if served >= len(script) {
+		return script[len(script)-1]
+	}
+	return script[served]
+}
+
+// Handler serves GET /api/orders/{number} like the accrual system does.
+func (s *Server) Handler() http.Handler {
+	router := gin.New()
+	router.Use(gin.Recovery())
+	router.GET("/api/orders/:number", s.getOrder)
+	return router
+}
+
+func (s *Server) getOrder(ctx *gin.Context) {
+	number := ctx.Param("number")
+	resp, limit := s.next(number)
+
+	if resp.Delay > 0 {
+		select {
+		case <-time.After(resp.Delay):
+		case <-ctx.Request.Context().Done():
+			return
+		}
+	}
+
+	switch {
+	case resp.Code == http.StatusTooManyRequests:
+		retryAfter := resp.RetryAfter
+		if retryAfter <= 0 {
+			retryAfter = defaultRetryAfter
+		}
+
+		ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		if limit > 0 {
+			ctx.String(http.StatusTooManyRequests, "No more than %d requests per minute allowed", limit)
+			return
+		}
+		ctx.Status(http.StatusTooManyRequests)
+	case resp.Code != 0 && resp.Code != http.StatusOK:
+		ctx.Status(resp.Code)
+	default:
+		ctx.JSON(http.StatusOK, accrual.OrderAccrual{
+			Order:   number,
+			Status:  resp.Status,
+			Accrual: resp.Accrual,
+		})
+	}
+}
+
+// Script file format, durations are Go duration strings:
+//
+//	{
+//	  "default": [{"status": "REGISTERED"}, {"status": "PROCESSED", "accrual": 500}],
+//	  "orders": {"12345678903": [{"code": 429, "retry_after": "5s"}, {"status": "INVALID"}]}
+//	}
+type scriptFile struct {
+	Default []scriptResponse            `json:"default"`
+	Orders  map[string][]scriptResponse `json:"orders"`
+}
+
+type scriptResponse struct {
+	Status     string       `json:"status"`
+	Accrual    *model.Money `json:"accrual"`
+	Code       int          `json:"code"`
+	RetryAfter string       `json:"retry_after"`
+	Delay      string       `json:"delay"`
+}
+
+func (r scriptResponse) response() (Response, error) {
+	resp := Response{
+		Status:  r.Status,
+		Accrual: r.Accrual,
+		Code:    r.Code,
+	}
+
+	var err error
+	if r.RetryAfter != "" {
+		resp.RetryAfter, err = time.ParseDuration(r.RetryAfter)
+		if err != nil {
+			return Response{}, err
+		}
+	}
+
+	if r.Delay != "" {
+		resp.Delay, err = time.ParseDuration(r.Delay)
+		if err != nil {
+			return Response{}, err
+		}
+	}
+
+	switch resp.Status {
+	case "", accrual.StatusRegistered, accrual.StatusProcessing, accrual.StatusInvalid, accrual.StatusProcessed:
+	default:
+		return Response{}, fmt.Errorf("error: unknown accrual status %q", resp.Status)
+	}
+
+	if resp.Status == "" && resp.Code == 0 {
+		return Response{}, fmt.Errorf("error: response needs a status or a code")
+	}
+
+	return resp, nil
+}
+
+func responses(script []scriptResponse) ([]Response, error) {
+	res := make([]Response, 0, len(script))
+	for _, r := range script {
+		resp, err := r.response()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, resp)
+	}
+	return res, nil
+}
+
+// LoadScript reads a JSON script file and applies it to the server.
+func (s *Server) LoadScript(r io.Reader) error {
+	var file scriptFile
+	err := json.NewDecoder(r).Decode(&file)
+	if err != nil {
+		return err
+	}
+
+	fallback, err := responses(file.Default)
+	if err != nil {
+		return err
+	}
+
+	for number, script := range file.Orders {
+		resps, err := responses(script)
+		if err != nil {
+			return fmt.Errorf("order %s: %w", number, err)
+		}
+		s.Script(number, resps...)
+	}
+
+	s.Default(fallback...)
+	return nil
+}
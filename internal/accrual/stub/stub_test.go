@@ -0,0 +1,137 @@
+package stub
+
+import (
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/accrual"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+func get(t *testing.T, s *Server, number string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/orders/"+number, nil))
+	return w
+}
+
+func TestServer_Script(t *testing.T) {
+	s := NewServer()
+	s.Script("1", Registered(), Processing(), Processed(50050))
+
+	want := []string{
+		`{"order":"1","status":"REGISTERED"}`,
+		`{"order":"1","status":"PROCESSING"}`,
+		`{"order":"1","status":"PROCESSED","accrual":500.5}`,
+		`{"order":"1","status":"PROCESSED","accrual":500.5}`,
+	}
+	for _, body := range want {
+		w := get(t, s, "1")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.JSONEq(t, body, w.Body.String())
+	}
+	require.Equal(t, 4, s.Requests("1"))
+
+	w := get(t, s, "2")
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	s.Default(Invalid())
+	w = get(t, s, "2")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"order":"2","status":"INVALID"}`, w.Body.String())
+}
+
+func TestServer_Inject(t *testing.T) {
+	s := NewServer()
+	s.Script("1", Registered(), Processed(100))
+	s.Inject(Failure(http.StatusInternalServerError), TooManyRequests(1500*time.Millisecond))
+
+	w := get(t, s, "1")
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+
+	w = get(t, s, "1")
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "2", w.Header().Get("Retry-After"))
+
+	w = get(t, s, "1")
+	require.JSONEq(t, `{"order":"1","status":"REGISTERED"}`, w.Body.String())
+}
+
+func TestServer_RateLimit(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	s := NewServer()
+	s.now = func() time.Time { return now }
+	s.SetRateLimit(2)
+
+	for i := 0; i < 2; i++ {
+		require.Equal(t, http.StatusNoContent, get(t, s, "1").Code)
+	}
+
+	now = now.Add(20 * time.Second)
+	w := get(t, s, "1")
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "40", w.Header().Get("Retry-After"))
+	require.Equal(t, "No more than 2 requests per minute allowed", w.Body.String())
+
+	now = now.Add(time.Minute)
+	require.Equal(t, http.StatusNoContent, get(t, s, "1").Code)
+}
+
+func TestServer_Latency(t *testing.T) {
+	s := NewServer()
+	s.SetLatency(20 * time.Millisecond)
+	s.Script("1", Response{Status: accrual.StatusProcessing, Delay: 30 * time.Millisecond})
+
+	start := time.Now()
+	require.Equal(t, http.StatusOK, get(t, s, "1").Code)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestServer_LoadScript(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		wantErr bool
+	}{
+		{
+			name:   "ok",
+			script: `{"default":[{"status":"PROCESSED","accrual":10}],"orders":{"1":[{"code":429,"retry_after":"5s"},{"status":"INVALID","delay":"1ms"}]}}`,
+		},
+		{
+			name:    "unknown_status",
+			script:  `{"orders":{"1":[{"status":"DONE"}]}}`,
+			wantErr: true,
+		},
+		{
+			name:    "empty_response",
+			script:  `{"default":[{}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "bad_duration",
+			script:  `{"orders":{"1":[{"code":429,"retry_after":"soon"}]}}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := NewServer().LoadScript(strings.NewReader(tt.script))
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
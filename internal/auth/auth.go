@@ -1,58 +1,187 @@
 package auth
 
 import (
-	"crypto/sha1"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/golang-jwt/jwt/v5"
+	"time"
 )
 
 const (
-	passKey  = "492gl12bACtAT1My"
-	tokenKey = "Ce45L1mMzQw5w09z"
+	DefaultIssuer     = "gophermart"
+	DefaultAudience   = "gophermart-api"
+	DefaultTokenTTL   = 15 * time.Minute
+	DefaultRefreshTTL = 30 * 24 * time.Hour
 )
 
-func HashPass(password string) string {
-	h := sha1.New()
-	h.Write([]byte(password))
-
-	return fmt.Sprintf("%x", h.Sum([]byte(passKey)))
-}
+var (
+	ErrorTokenMalformed     = errors.New("error: token is malformed")
+	ErrorTokenExpired       = errors.New("error: token is expired")
+	ErrorTokenNotValidYet   = errors.New("error: token is not valid yet")
+	ErrorTokenWrongIssuer   = errors.New("error: token has wrong issuer")
+	ErrorTokenWrongAudience = errors.New("error: token has wrong audience")
+	ErrorTokenUnknownKey    = errors.New("error: token is signed with unknown key")
+	ErrorTokenSignature     = errors.New("error: token signature is invalid")
+)
 
 type claims struct {
-	jwt.MapClaims
+	jwt.RegisteredClaims
 	Login string `json:"login"`
 }
 
-func GenerateToken(login string) (string, error) {
+// AccessToken is the verified content of an access token.
+type AccessToken struct {
+	ID        string
+	Login     string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+type TokenManager struct {
+	keys       *KeySet
+	ttl        time.Duration
+	refreshTTL time.Duration
+	issuer     string
+	audience   string
+	now        func() time.Time
+}
+
+func NewTokenManager(keys *KeySet, ttl, refreshTTL time.Duration, issuer, audience string) *TokenManager {
+	return &TokenManager{
+		keys:       keys,
+		ttl:        ttl,
+		refreshTTL: refreshTTL,
+		issuer:     issuer,
+		audience:   audience,
+		now:        time.Now,
+	}
+}
+
+func (m *TokenManager) TTL() time.Duration {
+	return m.ttl
+}
+
+func (m *TokenManager) GenerateToken(login string) (string, error) {
+	now := m.now()
+	signing := m.keys.signingKey()
+
+	id, err := randomString(16)
+	if err != nil {
+		return "", err
+	}
+
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        id,
+			Issuer:    m.issuer,
+			Audience:  jwt.ClaimStrings{m.audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(m.ttl)),
+		},
 		Login: login,
 	})
+	token.Header["kid"] = signing.ID
 
-	signedToken, err := token.SignedString([]byte(tokenKey))
+	signedToken, err := token.SignedString(signing.Secret)
 	if err != nil {
 		return "", err
 	}
 	return signedToken, nil
 }
 
-func ParseToken(rawToken string) (string, error) {
-	token, err := jwt.ParseWithClaims(rawToken, &claims{}, func(token *jwt.Token) (interface{}, error) {
+func (m *TokenManager) ParseToken(rawToken string) (AccessToken, error) {
+	token, err := jwt.ParseWithClaims(
+		rawToken,
+		&claims{},
+		m.keyFunc,
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(m.issuer),
+		jwt.WithAudience(m.audience),
+		jwt.WithIssuedAt(),
+		jwt.WithTimeFunc(m.now),
+	)
+	if err != nil {
+		return AccessToken{}, translateError(err)
+	}
+
+	claims, ok := token.Claims.(*claims)
+	if !ok {
+		return AccessToken{}, errors.New("wrong claims type provided")
+	}
+
+	if claims.ExpiresAt == nil || claims.IssuedAt == nil || claims.ID == "" {
+		return AccessToken{}, fmt.Errorf("%w: missing exp, iat or jti claim", ErrorTokenMalformed)
+	}
 
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("wrong signing method")
-		}
+	if claims.Login == "" {
+		return AccessToken{}, fmt.Errorf("%w: missing login claim", ErrorTokenMalformed)
+	}
 
-		return []byte(tokenKey), nil
-	})
+	return AccessToken{
+		ID:        claims.ID,
+		Login:     claims.Login,
+		IssuedAt:  claims.IssuedAt.Time,
+		ExpiresAt: claims.ExpiresAt.Time,
+	}, nil
+}
+
+// GenerateRefreshToken returns an opaque refresh token for the client and its hash for storage.
+func (m *TokenManager) GenerateRefreshToken() (token, hash string, expiresAt time.Time, err error) {
+	token, err = randomString(32)
 	if err != nil {
+		return "", "", time.Time{}, err
+	}
+
+	return token, HashRefreshToken(token), m.now().Add(m.refreshTTL), nil
+}
+
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
 		return "", err
 	}
 
-	claims, ok := token.Claims.(*claims)
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (m *TokenManager) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
 	if !ok {
-		return "", errors.New("wrong claims type provided")
+		return nil, ErrorTokenUnknownKey
 	}
 
-	return claims.Login, nil
+	secret, ok := m.keys.verificationKey(kid)
+	if !ok {
+		return nil, ErrorTokenUnknownKey
+	}
+
+	return secret, nil
+}
+
+func translateError(err error) error {
+	switch {
+	case errors.Is(err, ErrorTokenUnknownKey):
+		return ErrorTokenUnknownKey
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return ErrorTokenExpired
+	case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		return ErrorTokenNotValidYet
+	case errors.Is(err, jwt.ErrTokenInvalidIssuer):
+		return ErrorTokenWrongIssuer
+	case errors.Is(err, jwt.ErrTokenInvalidAudience):
+		return ErrorTokenWrongAudience
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid):
+		return ErrorTokenSignature
+	default:
+		return fmt.Errorf("%w: %v", ErrorTokenMalformed, err)
+	}
 }
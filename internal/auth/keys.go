@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const minSecretLen = 16
+
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// KeySet signs new tokens with its first key and verifies tokens with any of its keys,
+// so a new key can be rolled out while tokens signed with the old one are still accepted.
+type KeySet struct {
+	signing Key
+	keys    map[string][]byte
+}
+
+func NewKeySet(keys []Key) (*KeySet, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("error: at least one token key is required")
+	}
+
+	set := &KeySet{
+		signing: keys[0],
+		keys:    make(map[string][]byte, len(keys)),
+	}
+
+	for _, key := range keys {
+		if key.ID == "" {
+			return nil, errors.New("error: token key id must not be empty")
+		}
+
+		if len(key.Secret) < minSecretLen {
+			return nil, fmt.Errorf("error: token key %s must be at least %d bytes long", key.ID, minSecretLen)
+		}
+
+		if _, ok := set.keys[key.ID]; ok {
+			return nil, fmt.Errorf("error: duplicate token key id %s", key.ID)
+		}
+
+		set.keys[key.ID] = key.Secret
+	}
+
+	return set, nil
+}
+
+func (s *KeySet) signingKey() Key {
+	return s.signing
+}
+
+func (s *KeySet) verificationKey(id string) ([]byte, bool) {
+	secret, ok := s.keys[id]
+	return secret, ok
+}
+
+// ParseKeys parses a comma separated list of "kid:secret" pairs, the first pair is the signing key.
+func ParseKeys(value string) ([]Key, error) {
+	var keys []Key
+
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		key, err := parseKey(pair)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// LoadKeys reads "kid:secret" pairs from a file, one per line, the first one is the signing key.
+// Empty lines and lines starting with # are skipped.
+func LoadKeys(path string) ([]Key, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var keys []Key
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, err := parseKey(line)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func parseKey(pair string) (Key, error) {
+	id, secret, ok := strings.Cut(pair, ":")
+	if !ok || id == "" || secret == "" {
+		return Key{}, errors.New("error: token key must be in kid:secret format")
+	}
+
+	return Key{ID: id, Secret: []byte(secret)}, nil
+}
+
+// RandomKey generates an ephemeral signing key, tokens signed with it don't survive a restart.
+func RandomKey() (Key, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return Key{}, err
+	}
+
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return Key{}, err
+	}
+
+	return Key{ID: "ephemeral-" + hex.EncodeToString(id), Secret: secret}, nil
+}
@@ -0,0 +1,281 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/model"
+	"log"
+	"sync"
+	"time"
+)
+
+// LockoutPolicy describes how failed logins of a single key turn into temporary lockouts.
+type LockoutPolicy struct {
+	FreeAttempts int           // failures tolerated before the first lockout
+	BaseDelay    time.Duration // first lockout, doubled with every further failure
+	MaxDelay     time.Duration
+	Window       time.Duration // failures older than this are forgotten
+}
+
+// LoginAttemptsRetention bounds how long counters of idle logins and addresses are kept.
+const LoginAttemptsRetention = 24 * time.Hour
+
+var (
+	DefaultLoginLockout = LockoutPolicy{
+		FreeAttempts: 5,
+		BaseDelay:    time.Second,
+		MaxDelay:     15 * time.Minute,
+		Window:       time.Hour,
+	}
+
+	// DefaultIPLockout is looser, many users may share an address behind a NAT.
+	DefaultIPLockout = LockoutPolicy{
+		FreeAttempts: 50,
+		BaseDelay:    time.Second,
+		MaxDelay:     15 * time.Minute,
+		Window:       time.Hour,
+	}
+)
+
+func (p LockoutPolicy) delay(failures int) time.Duration {
+	over := failures - p.FreeAttempts
+	if over <= 0 {
+		return 0
+	}
+
+	if over > 32 {
+		return p.MaxDelay
+	}
+
+	d := p.BaseDelay << (over - 1)
+	if d <= 0 || d > p.MaxDelay {
+		return p.MaxDelay
+	}
+	return d
+}
+
+type attemptStore interface {
+	ReserveLoginAttempt(ctx context.Context, key string, now time.Time, window time.Duration, lockout func(failures int) time.Duration) (model.LoginAttempts, bool, error)
+	RefundLoginAttempt(ctx context.Context, key string) error
+	ResetLoginAttempts(ctx context.Context, key string) error
+	SaveLockoutEvent(ctx context.Context, event model.LockoutEvent) error
+}
+
+// LoginGuard counts login attempts per login name and per client address
+// and locks both out for exponentially growing periods.
+type LoginGuard struct {
+	store attemptStore
+	login LockoutPolicy
+	ip    LockoutPolicy
+	now   func() time.Time
+}
+
+func NewLoginGuard(store attemptStore, login, ip LockoutPolicy) *LoginGuard {
+	return &LoginGuard{
+		store: store,
+		login: login,
+		ip:    ip,
+		now:   time.Now,
+	}
+}
+
+type lockoutKey struct {
+	key    string
+	policy LockoutPolicy
+}
+
+// maxEventLogin is the length of the login column of lockout events, longer logins are cut.
+const maxEventLogin = 255
+
+// loginKey hashes the login, it is whatever the client sent and may be of any length.
+// Addresses come from the connection and are short already.
+func loginKey(login string) string {
+	sum := sha256.Sum256([]byte(login))
+	return "login:" + hex.EncodeToString(sum[:])
+}
+
+func (g *LoginGuard) keys(login, ip string) []lockoutKey {
+	keys := []lockoutKey{{key: loginKey(login), policy: g.login}}
+	if ip != "" {
+		keys = append(keys, lockoutKey{key: "ip:" + ip, policy: g.ip})
+	}
+	return keys
+}
+
+// Attempt counts an attempt as failed before the password is checked, so parallel guesses can't
+// all get through before the first failure lands. The attempt that crosses the limit locks the keys.
+// It returns how long the client has to wait when it's locked out, the attempt isn't counted then.
+func (g *LoginGuard) Attempt(ctx context.Context, login, ip string) (time.Duration, error) {
+	now := g.now()
+
+	var wait time.Duration
+	var reserved []string
+	for _, k := range g.keys(login, ip) {
+		attempts, ok, err := g.store.ReserveLoginAttempt(ctx, k.key, now, k.policy.Window, k.policy.delay)
+		if err != nil {
+			g.refund(ctx, reserved...)
+			return 0, err
+		}
+
+		if !ok {
+			if d := attempts.LockedUntil.Sub(now); d > wait {
+				wait = d
+			}
+			continue
+		}
+		reserved = append(reserved, k.key)
+
+		if !attempts.LockedUntil.After(now) {
+			continue
+		}
+
+		log.Printf("Locked out %s for %s after %d failed logins", k.key, attempts.LockedUntil.Sub(now), attempts.Failures)
+		err = g.store.SaveLockoutEvent(ctx, model.LockoutEvent{
+			Key:         k.key,
+			Login:       truncate(login, maxEventLogin),
+			IP:          ip,
+			Failures:    attempts.Failures,
+			LockedUntil: attempts.LockedUntil,
+			CreatedAt:   now,
+		})
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	if wait > 0 {
+		g.refund(ctx, reserved...)
+	}
+
+	return wait, nil
+}
+
+// Release gives back an attempt that didn't get to check the password.
+func (g *LoginGuard) Release(ctx context.Context, login, ip string) {
+	for _, k := range g.keys(login, ip) {
+		g.refund(ctx, k.key)
+	}
+}
+
+// Succeed clears the counter of the login and gives back the attempt of the address. The address
+// counter isn't cleared, so that a single valid account doesn't reset it while spraying others.
+func (g *LoginGuard) Succeed(ctx context.Context, login, ip string) error {
+	err := g.store.ResetLoginAttempts(ctx, loginKey(login))
+	if err != nil {
+		return err
+	}
+
+	if ip != "" {
+		return g.store.RefundLoginAttempt(ctx, "ip:"+ip)
+	}
+	return nil
+}
+
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n])
+}
+
+func (g *LoginGuard) refund(ctx context.Context, keys ...string) {
+	for _, key := range keys {
+		if err := g.store.RefundLoginAttempt(ctx, key); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// MemoryAttemptStore keeps login attempts in process memory, for tests and single instance setups.
+type MemoryAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]model.LoginAttempts
+	events   []model.LockoutEvent
+}
+
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{
+		attempts: make(map[string]model.LoginAttempts),
+	}
+}
+
+// ReserveLoginAttempt counts an attempt unless the key is locked, a counter idle for longer than window
+// starts over. The key is locked for lockout(failures) when that's positive.
+func (s *MemoryAttemptStore) ReserveLoginAttempt(_ context.Context, key string, now time.Time, window time.Duration, lockout func(failures int) time.Duration) (model.LoginAttempts, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempts := s.attempts[key]
+	if attempts.LockedUntil.After(now) {
+		return attempts, false, nil
+	}
+
+	if !attempts.LastFailureAt.After(now.Add(-window)) {
+		attempts.Failures = 0
+	}
+
+	attempts.Failures++
+	attempts.LastFailureAt = now
+	if d := lockout(attempts.Failures); d > 0 {
+		attempts.LockedUntil = now.Add(d)
+	}
+	s.attempts[key] = attempts
+
+	return attempts, true, nil
+}
+
+func (s *MemoryAttemptStore) RefundLoginAttempt(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if attempts, ok := s.attempts[key]; ok && attempts.Failures > 0 {
+		attempts.Failures--
+		s.attempts[key] = attempts
+	}
+
+	return nil
+}
+
+func (s *MemoryAttemptStore) ResetLoginAttempts(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.attempts, key)
+	return nil
+}
+
+func (s *MemoryAttemptStore) SaveLockoutEvent(_ context.Context, event model.LockoutEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *MemoryAttemptStore) DeleteExpiredLoginAttempts(_ context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var deleted int64
+
+	for key, attempts := range s.attempts {
+		if attempts.LastFailureAt.After(now.Add(-LoginAttemptsRetention)) || attempts.LockedUntil.After(now) {
+			continue
+		}
+
+		delete(s.attempts, key)
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+func (s *MemoryAttemptStore) LockoutEvents() []model.LockoutEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]model.LockoutEvent(nil), s.events...)
+}
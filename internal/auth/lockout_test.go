@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLockoutPolicy_Delay(t *testing.T) {
+	policy := LockoutPolicy{FreeAttempts: 3, BaseDelay: time.Second, MaxDelay: time.Minute}
+
+	tests := []struct {
+		name     string
+		failures int
+		want     time.Duration
+	}{
+		{name: "free", failures: 3, want: 0},
+		{name: "first_lockout", failures: 4, want: time.Second},
+		{name: "doubled", failures: 6, want: 4 * time.Second},
+		{name: "capped", failures: 20, want: time.Minute},
+		{name: "overflow", failures: 200, want: time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, policy.delay(tt.failures))
+		})
+	}
+}
+
+func TestLoginGuard(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryAttemptStore()
+
+	now := testNow
+	guard := NewLoginGuard(
+		store,
+		LockoutPolicy{FreeAttempts: 2, BaseDelay: time.Second, MaxDelay: time.Minute, Window: time.Hour},
+		LockoutPolicy{FreeAttempts: 4, BaseDelay: time.Second, MaxDelay: time.Minute, Window: time.Hour},
+	)
+	guard.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		wait, err := guard.Attempt(ctx, "user", "10.0.0.1")
+		require.NoError(t, err)
+		require.Zero(t, wait)
+	}
+
+	// the attempt crossing the limit goes through and locks the login
+	wait, err := guard.Attempt(ctx, "user", "10.0.0.1")
+	require.NoError(t, err)
+	require.Zero(t, wait)
+
+	wait, err = guard.Attempt(ctx, "user", "10.0.0.2")
+	require.NoError(t, err)
+	require.Equal(t, time.Second, wait)
+
+	// another login from the same address isn't locked yet
+	wait, err = guard.Attempt(ctx, "other", "10.0.0.1")
+	require.NoError(t, err)
+	require.Zero(t, wait)
+
+	now = now.Add(time.Second)
+	wait, err = guard.Attempt(ctx, "user", "10.0.0.1")
+	require.NoError(t, err)
+	require.Zero(t, wait)
+
+	wait, err = guard.Attempt(ctx, "user", "10.0.0.2")
+	require.NoError(t, err)
+	require.Equal(t, 2*time.Second, wait)
+
+	// the address crossed its own limit, so every login from it is locked
+	wait, err = guard.Attempt(ctx, "third", "10.0.0.1")
+	require.NoError(t, err)
+	require.Equal(t, time.Second, wait)
+
+	require.Len(t, store.LockoutEvents(), 3)
+
+	// rejected attempts aren't counted
+	require.Zero(t, store.attempts[loginKey("third")].Failures)
+	require.Zero(t, store.attempts["ip:10.0.0.2"].Failures)
+
+	require.NoError(t, guard.Succeed(ctx, "user", "10.0.0.1"))
+	wait, err = guard.Attempt(ctx, "user", "10.0.0.2")
+	require.NoError(t, err)
+	require.Zero(t, wait)
+
+	// counters start over after the window
+	now = now.Add(2 * time.Hour)
+	wait, err = guard.Attempt(ctx, "other", "10.0.0.1")
+	require.NoError(t, err)
+	require.Zero(t, wait)
+	require.Equal(t, 1, store.attempts["ip:10.0.0.1"].Failures)
+}
+
+func TestLoginGuard_Concurrent(t *testing.T) {
+	const attempts = 50
+
+	guard := NewLoginGuard(
+		NewMemoryAttemptStore(),
+		LockoutPolicy{FreeAttempts: 2, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: time.Hour},
+		DefaultIPLockout,
+	)
+
+	var allowed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait, err := guard.Attempt(context.Background(), "user", "10.0.0.1")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if wait == 0 {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the free attempts and the one locking the login
+	require.Equal(t, int32(3), allowed.Load())
+}
+
+func TestLoginGuard_LongLogin(t *testing.T) {
+	store := NewMemoryAttemptStore()
+	guard := NewLoginGuard(store, LockoutPolicy{FreeAttempts: 1, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: time.Hour}, DefaultIPLockout)
+	now := time.Now()
+	guard.now = func() time.Time { return now }
+	login := strings.Repeat("ё", 1000)
+
+	for i := 0; i < 2; i++ {
+		wait, err := guard.Attempt(context.Background(), login, "10.0.0.1")
+		require.NoError(t, err)
+		require.Zero(t, wait)
+	}
+
+	wait, err := guard.Attempt(context.Background(), login, "10.0.0.1")
+	require.NoError(t, err)
+	require.Equal(t, time.Minute, wait)
+
+	events := store.LockoutEvents()
+	require.Len(t, events, 1)
+	require.Len(t, events[0].Key, len("login:")+sha256.Size*2)
+	require.Equal(t, strings.Repeat("ё", maxEventLogin), events[0].Login)
+}
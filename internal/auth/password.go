@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"strings"
+	"sync"
+)
+
+// passKey is the suffix of legacy SHA-1 hashes, kept only to verify and upgrade them.
+const passKey = "492gl12bACtAT1My"
+
+const argon2Prefix = "$argon2id$"
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	saltLen uint32
+	keyLen  uint32
+}
+
+var currentArgon2Params = argon2Params{
+	memory:  19 * 1024,
+	time:    2,
+	threads: 1,
+	saltLen: 16,
+	keyLen:  32,
+}
+
+var ErrorMalformedHash = errors.New("error: malformed password hash")
+
+// HashPass returns a salted argon2id hash in the PHC string format:
+// $argon2id$v=19$m=19456,t=2,p=1$<salt>$<key>
+func HashPass(password string) (string, error) {
+	return hashWithParams(password, currentArgon2Params)
+}
+
+func hashWithParams(password string, p argon2Params) (string, error) {
+	salt := make([]byte, p.saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, p.keyLen)
+
+	return fmt.Sprintf(
+		"%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2Prefix,
+		argon2.Version,
+		p.memory,
+		p.time,
+		p.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// CheckPass reports whether password matches hash and whether the hash
+// should be replaced with a fresh HashPass result (legacy or outdated parameters).
+func CheckPass(hash, password string) (ok bool, needsRehash bool, err error) {
+	if !strings.HasPrefix(hash, argon2Prefix) {
+		legacy := legacyHashPass(password)
+		ok = subtle.ConstantTimeCompare([]byte(hash), []byte(legacy)) == 1
+		return ok, ok, nil
+	}
+
+	p, salt, key, err := decodeArgon2Hash(hash)
+	if err != nil {
+		return false, false, err
+	}
+
+	candidate := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, p.keyLen)
+	if subtle.ConstantTimeCompare(key, candidate) != 1 {
+		return false, false, nil
+	}
+
+	return true, p != currentArgon2Params, nil
+}
+
+var (
+	dummyHash     string
+	dummyHashOnce sync.Once
+)
+
+// CheckDummyPass costs as much as checking a wrong password, it is used for unknown logins.
+func CheckDummyPass(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = HashPass("")
+	})
+
+	_, _, _ = CheckPass(dummyHash, password)
+}
+
+func decodeArgon2Hash(hash string) (argon2Params, []byte, []byte, error) {
+	parts := strings.Split(strings.TrimPrefix(hash, argon2Prefix), "$")
+	if len(parts) != 4 {
+		return argon2Params{}, nil, nil, ErrorMalformedHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[0], "v=%d", &version); err != nil || version != argon2.Version {
+		return argon2Params{}, nil, nil, ErrorMalformedHash
+	}
+
+	var p argon2Params
+	if _, err := fmt.Sscanf(parts[1], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return argon2Params{}, nil, nil, ErrorMalformedHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return argon2Params{}, nil, nil, ErrorMalformedHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) == 0 {
+		return argon2Params{}, nil, nil, ErrorMalformedHash
+	}
+
+	p.saltLen = uint32(len(salt))
+	p.keyLen = uint32(len(key))
+
+	return p, salt, key, nil
+}
+
+func legacyHashPass(password string) string {
+	h := sha1.New()
+	h.Write([]byte(password))
+
+	return fmt.Sprintf("%x", h.Sum([]byte(passKey)))
+}
@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestLegacyHashPass(t *testing.T) {
+	tests := []struct {
+		name       string
+		pass       string
+		hashedPass string
+	}{
+		{
+			name:       "digits_small",
+			pass:       "123",
+			hashedPass: "343932676c3132624143744154314d7940bd001563085fc35165329ea1ff5c5ecbdbbeef",
+		},
+		{
+			name:       "digits_large",
+			pass:       "1233213213132123124465565681478732804197120947127480327560",
+			hashedPass: "343932676c3132624143744154314d79732049e4e7cd01be7ca356d6af789551f44c9df2",
+		},
+		{
+			name:       "alpha_small",
+			pass:       "abc",
+			hashedPass: "343932676c3132624143744154314d79a9993e364706816aba3e25717850c26c9cd0d89d",
+		},
+		{
+			name:       "alpha_large",
+			pass:       "abcdfjawfehuiwafhoeuwhfiowafluwuhfwiqwueiopuia",
+			hashedPass: "343932676c3132624143744154314d7905d8287962a12ba087d15b65d258bd20632821de",
+		},
+		{
+			name:       "random",
+			pass:       "NnhqXCgRtX7FPSH!zTpKYkG#dAeoM!rJrpgEB6Hr",
+			hashedPass: "343932676c3132624143744154314d79c800078494d3bde04c6b000f72f9e67c266baaaf",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.hashedPass, legacyHashPass(tt.pass))
+		})
+	}
+}
+
+func TestHashPass(t *testing.T) {
+	hash, err := HashPass("secret")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=19456,t=2,p=1$"))
+	require.LessOrEqual(t, len(hash), 255)
+
+	other, err := HashPass("secret")
+	require.NoError(t, err)
+	require.NotEqual(t, hash, other, "hashes must be salted")
+}
+
+func TestCheckPass(t *testing.T) {
+	current, err := HashPass("secret")
+	require.NoError(t, err)
+
+	outdated, err := hashWithParams("secret", argon2Params{memory: 8 * 1024, time: 1, threads: 1, saltLen: 16, keyLen: 32})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		hash        string
+		pass        string
+		ok          bool
+		needsRehash bool
+		wantErr     bool
+	}{
+		{
+			name: "current_ok",
+			hash: current,
+			pass: "secret",
+			ok:   true,
+		},
+		{
+			name: "current_wrong_pass",
+			hash: current,
+			pass: "Secret",
+		},
+		{
+			name:        "outdated_params",
+			hash:        outdated,
+			pass:        "secret",
+			ok:          true,
+			needsRehash: true,
+		},
+		{
+			name:        "legacy_ok",
+			hash:        "343932676c3132624143744154314d79a9993e364706816aba3e25717850c26c9cd0d89d",
+			pass:        "abc",
+			ok:          true,
+			needsRehash: true,
+		},
+		{
+			name: "legacy_wrong_pass",
+			hash: "343932676c3132624143744154314d79a9993e364706816aba3e25717850c26c9cd0d89d",
+			pass: "abcd",
+		},
+		{
+			name:    "malformed",
+			hash:    "$argon2id$v=19$garbage",
+			pass:    "secret",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, needsRehash, err := CheckPass(tt.hash, tt.pass)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.ok, ok)
+			require.Equal(t, tt.needsRehash, needsRehash)
+		})
+	}
+}
@@ -3,69 +3,291 @@ package configuration
 import (
 	"context"
 	"errors"
+	"fmt"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/accrual"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/auth"
 	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/handler"
 	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/model"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/repository/memory"
 	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/repository/postgre"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/validation"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/worker"
 	"github.com/gin-gonic/gin"
-	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
 	envAddress    = "RUN_ADDRESS"
 	envDsn        = "DATABASE_URI"
 	envAccAddress = "ACCRUAL_SYSTEM_ADDRESS"
+	envStorage    = "STORAGE"
+	envConfig     = "CONFIG"
+
+	envAccrualPath    = "ACCRUAL_PATH"
+	envAccrualTimeout = "ACCRUAL_TIMEOUT"
+
+	envAccrualGiveUpAfter = "ACCRUAL_GIVE_UP_AFTER"
+	envAccrualBackoffBase = "ACCRUAL_BACKOFF_BASE"
+	envAccrualBackoffMax  = "ACCRUAL_BACKOFF_MAX"
+	envAccrualBatchSize   = "ACCRUAL_BATCH_SIZE"
+	envAccrualWorkers     = "ACCRUAL_WORKERS"
+	envAccrualMaxInFlight = "ACCRUAL_MAX_IN_FLIGHT"
+	envAccrualInterval    = "ACCRUAL_POLL_INTERVAL"
+
+	envDBMinConns     = "DATABASE_MIN_CONNS"
+	envDBMaxConns     = "DATABASE_MAX_CONNS"
+	envRequestTimeout = "REQUEST_TIMEOUT"
+	envTrustedProxies = "TRUSTED_PROXIES"
+
+	envTokenTTL      = "TOKEN_TTL"
+	envRefreshTTL    = "REFRESH_TOKEN_TTL"
+	envTokenKeys     = "TOKEN_KEYS"
+	envTokenKeysFile = "TOKEN_KEYS_FILE"
+
+	envAuthCookie         = "AUTH_COOKIE"
+	envAuthCookieInsecure = "AUTH_COOKIE_INSECURE"
+
+	envLoginPattern       = "LOGIN_PATTERN"
+	envPasswordMinLength  = "PASSWORD_MIN_LENGTH"
+	envPasswordMinClasses = "PASSWORD_MIN_CLASSES"
+	envPasswordDenylist   = "PASSWORD_DENYLIST_FILE"
+
+	defaultRequestTimeout = 10 * time.Second
+
+	StoragePostgres = "postgres"
+	StorageMemory   = "memory"
 )
 
 type repository interface {
-	Create(user model.User) error
-	UpdateOrder(login string, order model.Order) error
-	GetOrderOwner(orderNum string) (login string, err error)
-	GetUser(login string) (model.User, error)
-	GetOrders(login string) ([]model.Order, error)
-	GetProcessingOrders() ([]model.Order, error)
-	Withdraw(login string, withdraw model.Withdraw) error
-	GetWithdrawals(login string) ([]model.Withdraw, error)
+	Create(ctx context.Context, user model.User) error
+	UpdateOrder(ctx context.Context, login string, order model.Order) error
+	GetOrderOwner(ctx context.Context, orderNum string) (login string, err error)
+	GetUser(ctx context.Context, login string) (model.User, error)
+	UpdatePassword(ctx context.Context, login, password string) error
+	GetOrders(ctx context.Context, login string) ([]model.Order, error)
+	GetBalance(ctx context.Context, login string) (model.Balance, error)
+	Withdraw(ctx context.Context, login string, withdraw model.Withdraw) error
+	GetWithdrawals(ctx context.Context, login string) ([]model.Withdraw, error)
+	LeaseAccrualJobs(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]model.AccrualJob, error)
+	RescheduleAccrualJob(ctx context.Context, number string, nextPollAt time.Time) error
+	GetIdempotentResponse(ctx context.Context, login, key string) (model.IdempotentResponse, bool, error)
+	ReserveIdempotencyKey(ctx context.Context, login, key, requestHash string, ttl time.Duration) (model.IdempotentResponse, bool, error)
+	ReleaseIdempotencyKey(ctx context.Context, login, key string) error
+	SaveIdempotentResponse(ctx context.Context, login, key string, resp model.IdempotentResponse, ttl time.Duration) error
+	DeleteExpiredIdempotencyKeys(ctx context.Context) (int64, error)
+	SaveRefreshToken(ctx context.Context, login, hash string, expiresAt time.Time) error
+	RotateRefreshToken(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (string, error)
+	RevokeRefreshToken(ctx context.Context, login, hash string) error
+	RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error
+	RevokeAllTokens(ctx context.Context, login string) error
+	IsAccessTokenRevoked(ctx context.Context, jti, login string, issuedAt time.Time) (bool, error)
+	DeleteExpiredTokens(ctx context.Context) (int64, error)
+	ReserveLoginAttempt(ctx context.Context, key string, now time.Time, window time.Duration, lockout func(failures int) time.Duration) (model.LoginAttempts, bool, error)
+	RefundLoginAttempt(ctx context.Context, key string) error
+	ResetLoginAttempts(ctx context.Context, key string) error
+	SaveLockoutEvent(ctx context.Context, event model.LockoutEvent) error
+	DeleteExpiredLoginAttempts(ctx context.Context) (int64, error)
+}
+
+type workerPool interface {
+	Run(ctx context.Context)
+	Shutdown(ctx context.Context) error
+	Health() worker.Health
+}
+
+// Flags holds command line values, each of them falls back to its environment variable when unset.
+type Flags struct {
+	Address        *string
+	Dsn            *string
+	AccAddress     *string
+	Storage        *string
+	Config         *string
+	AccPath        *string
+	AccTimeout     *time.Duration
+	Workers        *int
+	PollInterval   *time.Duration
+	MaxInFlight    *int
+	GiveUpAfter    *time.Duration
+	BackoffBase    *time.Duration
+	BackoffMax     *time.Duration
+	BatchSize      *int
+	DBMinConns     *int
+	DBMaxConns     *int
+	RequestTimeout *time.Duration
+	TrustedProxies *string
+	TokenTTL       *time.Duration
+	RefreshTTL     *time.Duration
+	TokenKeys      *string
+	TokenKeysFile  *string
+
+	AuthCookie         *bool
+	AuthCookieInsecure *bool
+
+	LoginPattern       *string
+	PasswordMinLength  *int
+	PasswordMinClasses *int
+	PasswordDenylist   *string
 }
 
 type configuration struct {
 	Address    string
 	Dsn        string
 	AccAddress string
-	DB         *pgx.Conn
+	AccPath    string
+	AccTimeout time.Duration
+	Accrual    *accrual.Client
+	Worker     worker.Config
+	Pool       workerPool
+	DB         *pgxpool.Pool
 	Storage    repository
 	Server     *http.Server
 }
 
-func NewConfiguration(flAddress, flDsn, flAccAddress *string) (configuration, error) {
-	address, err := parseStringVar(flAddress, envAddress)
+func NewConfiguration(fl Flags) (configuration, error) {
+	address, err := ParseStringVar(fl.Address, envAddress)
+	if err != nil {
+		return configuration{}, err
+	}
+
+	accAddress, err := ParseStringVar(fl.AccAddress, envAccAddress)
+	if err != nil {
+		return configuration{}, err
+	}
+
+	file, err := loadFile(ParseOptionalStringVar(fl.Config, envConfig))
+	if err != nil {
+		return configuration{}, err
+	}
+
+	accPath := ParseOptionalStringVar(fl.AccPath, envAccrualPath)
+	if accPath == "" {
+		accPath = file.Accrual.Path
+	}
+	if accPath == "" {
+		accPath = accrual.DefaultPath
+	}
+
+	accTimeout, err := ParseDurationVar(fl.AccTimeout, envAccrualTimeout, time.Duration(file.Accrual.Timeout))
+	if err != nil {
+		return configuration{}, err
+	}
+	if accTimeout == 0 {
+		accTimeout = accrual.DefaultTimeout
+	}
+	if accTimeout < 0 {
+		return configuration{}, errors.New("accrual timeout must be positive")
+	}
+
+	client, err := accrual.NewClient(accAddress, accPath, &http.Client{}, accTimeout, nil)
 	if err != nil {
 		return configuration{}, err
 	}
 
-	dsn, err := parseStringVar(flDsn, envDsn)
+	workerConfig, err := newWorkerConfig(fl, file)
 	if err != nil {
 		return configuration{}, err
 	}
 
-	accAddress, err := parseStringVar(flAccAddress, envAccAddress)
+	minConns, err := ParseIntVar(fl.DBMinConns, envDBMinConns)
 	if err != nil {
 		return configuration{}, err
 	}
 
-	conn, err := pgx.Connect(context.Background(), dsn)
+	maxConns, err := ParseIntVar(fl.DBMaxConns, envDBMaxConns)
 	if err != nil {
 		return configuration{}, err
 	}
 
-	storage, err := postgre.NewStorage(conn)
+	requestTimeout, err := ParseDurationVar(fl.RequestTimeout, envRequestTimeout, defaultRequestTimeout)
 	if err != nil {
 		return configuration{}, err
 	}
 
+	trustedProxies := parseList(ParseOptionalStringVar(fl.TrustedProxies, envTrustedProxies))
+
+	tokenTTL, err := ParseDurationVar(fl.TokenTTL, envTokenTTL, auth.DefaultTokenTTL)
+	if err != nil {
+		return configuration{}, err
+	}
+
+	refreshTTL, err := ParseDurationVar(fl.RefreshTTL, envRefreshTTL, auth.DefaultRefreshTTL)
+	if err != nil {
+		return configuration{}, err
+	}
+
+	tokens, err := newTokenManager(fl.TokenKeys, fl.TokenKeysFile, tokenTTL, refreshTTL)
+	if err != nil {
+		return configuration{}, err
+	}
+
+	cookieMode, err := ParseBoolVar(fl.AuthCookie, envAuthCookie)
+	if err != nil {
+		return configuration{}, err
+	}
+
+	cookieInsecure, err := ParseBoolVar(fl.AuthCookieInsecure, envAuthCookieInsecure)
+	if err != nil {
+		return configuration{}, err
+	}
+
+	cookies := handler.CookieConfig{
+		Enabled: cookieMode,
+		Secure:  !cookieInsecure,
+	}
+
+	credentials, err := newCredentialPolicy(fl)
+	if err != nil {
+		return configuration{}, err
+	}
+
+	var dsn string
+	var pool *pgxpool.Pool
+	var storage repository
+
+	switch kind := ParseOptionalStringVar(fl.Storage, envStorage); kind {
+	case "", StoragePostgres:
+		dsn, err = ParseStringVar(fl.Dsn, envDsn)
+		if err != nil {
+			return configuration{}, err
+		}
+
+		pool, err = newPool(context.Background(), dsn, minConns, maxConns)
+		if err != nil {
+			return configuration{}, err
+		}
+
+		err = migrate(context.Background(), pool)
+		if err != nil {
+			pool.Close()
+			return configuration{}, err
+		}
+
+		storage = postgre.NewStorage(pool)
+	case StorageMemory:
+		log.Println("Warning: using in-memory storage, all data is lost on restart")
+		storage = memory.NewStorage()
+	default:
+		return configuration{}, fmt.Errorf("unknown storage %q, expected %s or %s", kind, StoragePostgres, StorageMemory)
+	}
+
 	gin.SetMode(gin.ReleaseMode)
-	router := newRouter(storage)
+	guard := auth.NewLoginGuard(storage, auth.DefaultLoginLockout, auth.DefaultIPLockout)
+	wp := worker.NewWorkerPool(workerConfig, client, storage)
+	router, err := newRouter(storage, wp, tokens, guard, credentials, cookies, requestTimeout, trustedProxies)
+	if err != nil {
+		if pool != nil {
+			pool.Close()
+		}
+		return configuration{}, err
+	}
 
 	server := &http.Server{
 		Addr:    address,
@@ -76,13 +298,274 @@ func NewConfiguration(flAddress, flDsn, flAccAddress *string) (configuration, er
 		Address:    address,
 		Dsn:        dsn,
 		AccAddress: accAddress,
-		DB:         conn,
+		AccPath:    accPath,
+		AccTimeout: accTimeout,
+		Accrual:    client,
+		Worker:     workerConfig,
+		Pool:       wp,
+		DB:         pool,
 		Storage:    storage,
 		Server:     server,
 	}, nil
 }
 
-func parseStringVar(flag *string, envName string) (string, error) {
+// String describes the resolved configuration for the startup log, with passwords redacted.
+func (c configuration) String() string {
+	storage := StoragePostgres
+	if c.DB == nil {
+		storage = StorageMemory
+	}
+
+	w := c.Worker
+	return fmt.Sprintf("address=%s storage=%s dsn=%q accrual=%s accrual_path=%s accrual_timeout=%s "+
+		"workers=%d batch_size=%d max_in_flight=%d poll_interval=%s give_up_after=%s backoff=%s..%s",
+		c.Address, storage, redact(c.Dsn), redact(c.AccAddress), c.AccPath, c.AccTimeout,
+		w.Size, w.BatchSize, w.MaxInFlight, w.PollInterval, w.GiveUpAfter, w.Backoff.Base, w.Backoff.Max)
+}
+
+var passwordRe = regexp.MustCompile(`(?i)(password=)('[^']*'|[^\s&]+)`)
+
+// redact hides the password of a URL or of a key/value database dsn.
+func redact(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.User != nil {
+		dsn = u.Redacted()
+	}
+
+	return passwordRe.ReplaceAllString(dsn, "${1}xxxxx")
+}
+
+// Close releases the database connections, if any.
+func (c configuration) Close() {
+	if c.DB != nil {
+		c.DB.Close()
+	}
+}
+
+func NewStorage(ctx context.Context, flDsn *string) (*postgre.Storage, *pgxpool.Pool, error) {
+	pool, err := NewDB(ctx, flDsn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = migrate(ctx, pool)
+	if err != nil {
+		pool.Close()
+		return nil, nil, err
+	}
+
+	return postgre.NewStorage(pool), pool, nil
+}
+
+func NewDB(ctx context.Context, flDsn *string) (*pgxpool.Pool, error) {
+	dsn, err := ParseStringVar(flDsn, envDsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return newPool(ctx, dsn, 0, 0)
+}
+
+func migrate(ctx context.Context, pool *pgxpool.Pool) error {
+	migrator, err := postgre.NewMigrator(pool)
+	if err != nil {
+		return err
+	}
+
+	applied, err := migrator.Up(ctx)
+	if err != nil {
+		return err
+	}
+
+	if applied > 0 {
+		log.Printf("Applied %d database migrations", applied)
+	}
+	return nil
+}
+
+// newPool connects to the database, zero connection limits keep the pgxpool defaults.
+func newPool(ctx context.Context, dsn string, minConns, maxConns int) (*pgxpool.Pool, error) {
+	poolConfig, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if minConns > 0 {
+		poolConfig.MinConns = int32(minConns)
+	}
+
+	if maxConns > 0 {
+		poolConfig.MaxConns = int32(maxConns)
+	}
+
+	if poolConfig.MinConns > poolConfig.MaxConns {
+		return nil, errors.New("database min connections exceed max connections")
+	}
+
+	return pgxpool.NewWithConfig(ctx, poolConfig)
+}
+
+// newTokenManager loads signing keys from the flag/env list or from a file,
+// without any configured keys an ephemeral one is generated.
+func newTokenManager(flKeys, flKeysFile *string, ttl, refreshTTL time.Duration) (*auth.TokenManager, error) {
+	if ttl <= 0 || refreshTTL <= 0 {
+		return nil, errors.New("token ttl must be positive")
+	}
+
+	var keys []auth.Key
+	var err error
+
+	if value := ParseOptionalStringVar(flKeys, envTokenKeys); value != "" {
+		keys, err = auth.ParseKeys(value)
+	} else if path := ParseOptionalStringVar(flKeysFile, envTokenKeysFile); path != "" {
+		keys, err = auth.LoadKeys(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		key, err := auth.RandomKey()
+		if err != nil {
+			return nil, err
+		}
+
+		log.Println("Warning: no token keys configured, issued tokens won't survive a restart")
+		keys = []auth.Key{key}
+	}
+
+	keySet, err := auth.NewKeySet(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return auth.NewTokenManager(keySet, ttl, refreshTTL, auth.DefaultIssuer, auth.DefaultAudience), nil
+}
+
+// newWorkerConfig overrides the default accrual polling settings with the config file and then
+// with the flags and environment variables.
+func newWorkerConfig(fl Flags, file fileConfig) (worker.Config, error) {
+	config := worker.DefaultConfig()
+
+	if file.Worker.Size != 0 {
+		config.Size = file.Worker.Size
+	}
+	if file.Worker.BatchSize != 0 {
+		config.BatchSize = file.Worker.BatchSize
+	}
+	if file.Worker.MaxInFlight != 0 {
+		config.MaxInFlight = file.Worker.MaxInFlight
+	}
+	if file.Worker.PollInterval != 0 {
+		config.PollInterval = time.Duration(file.Worker.PollInterval)
+	}
+	if file.Worker.GiveUpAfter != 0 {
+		config.GiveUpAfter = time.Duration(file.Worker.GiveUpAfter)
+	}
+	if file.Worker.BackoffBase != 0 {
+		config.Backoff.Base = time.Duration(file.Worker.BackoffBase)
+	}
+	if file.Worker.BackoffMax != 0 {
+		config.Backoff.Max = time.Duration(file.Worker.BackoffMax)
+	}
+
+	var err error
+	config.PollInterval, err = ParseDurationVar(fl.PollInterval, envAccrualInterval, config.PollInterval)
+	if err != nil {
+		return worker.Config{}, err
+	}
+
+	config.GiveUpAfter, err = ParseDurationVar(fl.GiveUpAfter, envAccrualGiveUpAfter, config.GiveUpAfter)
+	if err != nil {
+		return worker.Config{}, err
+	}
+
+	config.Backoff.Base, err = ParseDurationVar(fl.BackoffBase, envAccrualBackoffBase, config.Backoff.Base)
+	if err != nil {
+		return worker.Config{}, err
+	}
+
+	config.Backoff.Max, err = ParseDurationVar(fl.BackoffMax, envAccrualBackoffMax, config.Backoff.Max)
+	if err != nil {
+		return worker.Config{}, err
+	}
+
+	batchSize, err := ParseIntVar(fl.BatchSize, envAccrualBatchSize)
+	if err != nil {
+		return worker.Config{}, err
+	}
+	if batchSize != 0 {
+		config.BatchSize = batchSize
+	}
+
+	size, err := ParseIntVar(fl.Workers, envAccrualWorkers)
+	if err != nil {
+		return worker.Config{}, err
+	}
+	if size != 0 {
+		config.Size = size
+	}
+
+	maxInFlight, err := ParseIntVar(fl.MaxInFlight, envAccrualMaxInFlight)
+	if err != nil {
+		return worker.Config{}, err
+	}
+	if maxInFlight != 0 {
+		config.MaxInFlight = maxInFlight
+	}
+
+	return config, config.Check()
+}
+
+// newCredentialPolicy overrides the default registration rules with the configured ones.
+func newCredentialPolicy(fl Flags) (validation.CredentialPolicy, error) {
+	policy := validation.DefaultCredentialPolicy()
+
+	if pattern := ParseOptionalStringVar(fl.LoginPattern, envLoginPattern); pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return validation.CredentialPolicy{}, err
+		}
+		policy.LoginPattern = re
+	}
+
+	minLength, err := ParseIntVar(fl.PasswordMinLength, envPasswordMinLength)
+	if err != nil {
+		return validation.CredentialPolicy{}, err
+	}
+	if minLength != 0 {
+		policy.PasswordMinLength = minLength
+	}
+
+	minClasses, err := ParseIntVar(fl.PasswordMinClasses, envPasswordMinClasses)
+	if err != nil {
+		return validation.CredentialPolicy{}, err
+	}
+	if minClasses != 0 {
+		policy.PasswordMinClasses = minClasses
+	}
+
+	if path := ParseOptionalStringVar(fl.PasswordDenylist, envPasswordDenylist); path != "" {
+		policy.Denylist, err = validation.LoadDenylist(path)
+		if err != nil {
+			return validation.CredentialPolicy{}, err
+		}
+		log.Printf("Loaded %d denylisted passwords", len(policy.Denylist))
+	}
+
+	return policy, policy.Check()
+}
+
+// ParseOptionalStringVar and the other Parse*Var helpers resolve a setting: a non-zero flag wins
+// over its environment variable, which wins over the default.
+func ParseOptionalStringVar(flag *string, envName string) string {
+	if *flag != "" {
+		return *flag
+	}
+
+	return os.Getenv(envName)
+}
+
+func ParseStringVar(flag *string, envName string) (string, error) {
 	if *flag != "" {
 		return *flag, nil
 	}
@@ -94,22 +577,80 @@ func parseStringVar(flag *string, envName string) (string, error) {
 	return value, nil
 }
 
-func newRouter(storage repository) *gin.Engine {
+func ParseIntVar(flag *int, envName string) (int, error) {
+	if *flag != 0 {
+		return *flag, nil
+	}
+
+	value := os.Getenv(envName)
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(value)
+}
+
+func ParseDurationVar(flag *time.Duration, envName string, defaultValue time.Duration) (time.Duration, error) {
+	if *flag != 0 {
+		return *flag, nil
+	}
+
+	value := os.Getenv(envName)
+	if value == "" {
+		return defaultValue, nil
+	}
+	return time.ParseDuration(value)
+}
+
+func ParseBoolVar(flag *bool, envName string) (bool, error) {
+	if *flag {
+		return true, nil
+	}
+
+	value := os.Getenv(envName)
+	if value == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// parseList splits a comma separated setting, dropping blank items.
+func parseList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// newRouter builds the HTTP routes. Forwarding headers are only honoured from trustedProxies, so with
+// none configured ClientIP is always the peer address and clients cannot pick the lockout address.
+func newRouter(storage repository, wp workerPool, tokens *auth.TokenManager, guard *auth.LoginGuard, credentials validation.CredentialPolicy, cookies handler.CookieConfig, requestTimeout time.Duration, trustedProxies []string) (*gin.Engine, error) {
 	router := gin.New()
-	auth := router.Group("/api/user")
+	if err := router.SetTrustedProxies(trustedProxies); err != nil {
+		return nil, fmt.Errorf("trusted proxies: %w", err)
+	}
+	router.Use(handler.TimeoutMiddleware(requestTimeout))
+	router.GET("/health", handler.Health(wp))
+
+	public := router.Group("/api/user")
 	{
-		auth.POST("/register", handler.Register(storage))
-		auth.POST("/login", handler.Login(storage))
+		public.POST("/register", handler.Register(storage, tokens, cookies, credentials))
+		public.POST("/login", handler.Login(storage, tokens, cookies, guard))
+		public.POST("/token/refresh", handler.RefreshToken(storage, tokens, cookies))
 	}
 
-	api := router.Group("/api/user", handler.AuthMiddleware, handler.CompressMiddleware, handler.DecompressMiddleware)
+	api := router.Group("/api/user", handler.AuthMiddleware(tokens, storage, cookies), handler.CompressMiddleware, handler.DecompressMiddleware)
 	{
 		api.POST("/orders", handler.UpdateOrder(storage))
 		api.GET("/orders", handler.GetOrders(storage))
 		api.GET("/balance", handler.GetBalance(storage))
-		api.POST("/balance/withdraw", handler.Withdraw(storage))
+		api.POST("/balance/withdraw", handler.IdempotencyMiddleware(storage), handler.Withdraw(storage))
 		api.GET("/withdrawals", handler.GetWithdrawals(storage))
+		api.POST("/logout", handler.Logout(storage, cookies))
+		api.POST("/logout/all", handler.LogoutAll(storage, cookies))
 	}
 
-	return router
+	return router, nil
 }
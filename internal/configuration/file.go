@@ -0,0 +1,75 @@
+package configuration
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// fileConfig is the config file, its values apply when neither the flag nor the environment
+// variable is set. Durations are Go duration strings:
+//
+//	{
+//	  "accrual": {"path": "/api/orders/", "timeout": "5s"},
+//	  "worker": {"size": 8, "batch_size": 50, "max_in_flight": 100, "poll_interval": "2s",
+//	             "give_up_after": "24h", "backoff_base": "1s", "backoff_max": "10m"}
+//	}
+type fileConfig struct {
+	Accrual struct {
+		Path    string   `json:"path"`
+		Timeout duration `json:"timeout"`
+	} `json:"accrual"`
+
+	Worker struct {
+		Size         int      `json:"size"`
+		BatchSize    int      `json:"batch_size"`
+		MaxInFlight  int      `json:"max_in_flight"`
+		PollInterval duration `json:"poll_interval"`
+		GiveUpAfter  duration `json:"give_up_after"`
+		BackoffBase  duration `json:"backoff_base"`
+		BackoffMax   duration `json:"backoff_max"`
+	} `json:"worker"`
+}
+
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var value string
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+
+	*d = duration(parsed)
+	return nil
+}
+
+// loadFile reads the config file, an empty path means there is none.
+func loadFile(path string) (fileConfig, error) {
+	var config fileConfig
+	if path == "" {
+		return config, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fileConfig{}, err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+
+	err = decoder.Decode(&config)
+	if err != nil {
+		return fileConfig{}, fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	return config, nil
+}
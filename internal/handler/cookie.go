@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookie = "gophermart_session"
+	refreshCookie = "gophermart_refresh"
+	csrfCookie    = "gophermart_csrf"
+	csrfHeader    = "X-CSRF-Token"
+
+	authRealm = "gophermart"
+)
+
+var (
+	errorNoToken        = errors.New("error: no access token provided")
+	errorBadAuthHeader  = errors.New("error: malformed authorization header")
+	errorUnknownScheme  = errors.New("error: unsupported authorization scheme")
+	errorCSRFValidation = errors.New("error: csrf token mismatch")
+)
+
+// CookieConfig enables the browser session mode: tokens are additionally set as HttpOnly cookies
+// and cookie-authenticated unsafe requests must echo the CSRF cookie in the X-CSRF-Token header.
+type CookieConfig struct {
+	Enabled bool
+	Secure  bool
+}
+
+// extractToken reads an RFC 6750 bearer token, a bare token (kept for existing clients)
+// or, in cookie mode, the session cookie.
+func extractToken(ctx *gin.Context, cookies CookieConfig) (token string, fromCookie bool, err error) {
+	header := ctx.GetHeader("Authorization")
+	if header != "" {
+		scheme, value, found := strings.Cut(header, " ")
+		if !found {
+			return header, false, nil
+		}
+
+		// other schemes carry no bearer token, the client gets the plain challenge (RFC 6750 3.1)
+		if !strings.EqualFold(scheme, "Bearer") {
+			return "", false, fmt.Errorf("%w: %w", errorNoToken, errorUnknownScheme)
+		}
+
+		value = strings.TrimSpace(value)
+		if value == "" || strings.Contains(value, " ") {
+			return "", false, errorBadAuthHeader
+		}
+
+		return value, false, nil
+	}
+
+	if cookies.Enabled {
+		if cookie, err := ctx.Cookie(sessionCookie); err == nil && cookie != "" {
+			return cookie, true, nil
+		}
+	}
+
+	return "", false, errorNoToken
+}
+
+// verifyCSRF implements the double submit cookie check for state changing requests.
+func verifyCSRF(ctx *gin.Context) error {
+	switch ctx.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return nil
+	}
+
+	cookie, err := ctx.Cookie(csrfCookie)
+	if err != nil || cookie == "" {
+		return errorCSRFValidation
+	}
+
+	header := ctx.GetHeader(csrfHeader)
+	if subtle.ConstantTimeCompare([]byte(cookie), []byte(header)) != 1 {
+		return errorCSRFValidation
+	}
+
+	return nil
+}
+
+// writeAuthError responds with a WWW-Authenticate challenge as described in RFC 6750, section 3.
+func writeAuthError(ctx *gin.Context, status int, code string, err error) {
+	challenge := fmt.Sprintf(`Bearer realm="%s"`, authRealm)
+	if code != "" {
+		challenge += fmt.Sprintf(`, error="%s", error_description="%s"`, code, strings.ReplaceAll(err.Error(), `"`, `'`))
+	}
+
+	ctx.Writer.Header().Set("WWW-Authenticate", challenge)
+	ctx.Writer.WriteHeader(status)
+	ctx.Abort()
+}
+
+func setSessionCookies(ctx *gin.Context, cookies CookieConfig, accessToken string, accessTTL time.Duration, refreshToken string, refreshExpiresAt time.Time) error {
+	csrf := make([]byte, 32)
+	if _, err := rand.Read(csrf); err != nil {
+		return err
+	}
+
+	http.SetCookie(ctx.Writer, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    accessToken,
+		Path:     "/api/",
+		MaxAge:   int(accessTTL.Seconds()),
+		Secure:   cookies.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	http.SetCookie(ctx.Writer, &http.Cookie{
+		Name:     refreshCookie,
+		Value:    refreshToken,
+		Path:     "/api/user/",
+		Expires:  refreshExpiresAt,
+		Secure:   cookies.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	http.SetCookie(ctx.Writer, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(csrf),
+		Path:     "/",
+		Expires:  refreshExpiresAt,
+		Secure:   cookies.Secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	return nil
+}
+
+func clearSessionCookies(ctx *gin.Context, cookies CookieConfig) {
+	for name, path := range map[string]string{
+		sessionCookie: "/api/",
+		refreshCookie: "/api/user/",
+		csrfCookie:    "/",
+	} {
+		http.SetCookie(ctx.Writer, &http.Cookie{
+			Name:     name,
+			Path:     path,
+			MaxAge:   -1,
+			Secure:   cookies.Secure,
+			HttpOnly: name != csrfCookie,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+}
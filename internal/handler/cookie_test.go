@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestContext(method, authHeader string, cookies ...*http.Cookie) *gin.Context {
+	req := httptest.NewRequest(method, "/api/user/orders", nil)
+	if authHeader != "" {
+		req.Header.Set("Authorization", authHeader)
+	}
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = req
+	return ctx
+}
+
+func TestExtractToken(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     string
+		cookies    CookieConfig
+		cookie     *http.Cookie
+		wantToken  string
+		fromCookie bool
+		wantErr    error
+	}{
+		{
+			name:      "bearer",
+			header:    "Bearer abc.def.ghi",
+			wantToken: "abc.def.ghi",
+		},
+		{
+			name:      "bearer_lower_case",
+			header:    "bearer abc.def.ghi",
+			wantToken: "abc.def.ghi",
+		},
+		{
+			name:      "bare_token",
+			header:    "abc.def.ghi",
+			wantToken: "abc.def.ghi",
+		},
+		{
+			name:    "basic_scheme",
+			header:  "Basic dXNlcjpwYXNz",
+			wantErr: errorNoToken,
+		},
+		{
+			name:    "empty_bearer",
+			header:  "Bearer ",
+			wantErr: errorBadAuthHeader,
+		},
+		{
+			name:    "no_token",
+			wantErr: errorNoToken,
+		},
+		{
+			name:    "cookie_mode_disabled",
+			cookie:  &http.Cookie{Name: sessionCookie, Value: "abc.def.ghi"},
+			wantErr: errorNoToken,
+		},
+		{
+			name:       "cookie",
+			cookies:    CookieConfig{Enabled: true},
+			cookie:     &http.Cookie{Name: sessionCookie, Value: "abc.def.ghi"},
+			wantToken:  "abc.def.ghi",
+			fromCookie: true,
+		},
+		{
+			name:      "header_wins_over_cookie",
+			header:    "Bearer header.token",
+			cookies:   CookieConfig{Enabled: true},
+			cookie:    &http.Cookie{Name: sessionCookie, Value: "abc.def.ghi"},
+			wantToken: "header.token",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cookies []*http.Cookie
+			if tt.cookie != nil {
+				cookies = append(cookies, tt.cookie)
+			}
+
+			token, fromCookie, err := extractToken(newTestContext(http.MethodGet, tt.header, cookies...), tt.cookies)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantToken, token)
+			require.Equal(t, tt.fromCookie, fromCookie)
+		})
+	}
+}
+
+func TestAuthMiddleware_Challenge(t *testing.T) {
+	tests := []struct {
+		name          string
+		header        string
+		wantStatus    int
+		wantChallenge string
+	}{
+		{
+			name:          "no_token",
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: `Bearer realm="` + authRealm + `"`,
+		},
+		{
+			name:          "basic_scheme",
+			header:        "Basic dXNlcjpwYXNz",
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: `Bearer realm="` + authRealm + `"`,
+		},
+		{
+			name:          "malformed_bearer",
+			header:        "Bearer a b",
+			wantStatus:    http.StatusBadRequest,
+			wantChallenge: `Bearer realm="` + authRealm + `", error="invalid_request", error_description="error: malformed authorization header"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.GET("/api/user/orders", AuthMiddleware(nil, nil, CookieConfig{}))
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/api/user/orders", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			router.ServeHTTP(w, req)
+
+			require.Equal(t, tt.wantStatus, w.Code)
+			require.Equal(t, tt.wantChallenge, w.Header().Get("WWW-Authenticate"))
+		})
+	}
+}
+
+func TestVerifyCSRF(t *testing.T) {
+	csrf := &http.Cookie{Name: csrfCookie, Value: "csrf-value"}
+
+	ctx := newTestContext(http.MethodGet, "")
+	require.NoError(t, verifyCSRF(ctx))
+
+	ctx = newTestContext(http.MethodPost, "", csrf)
+	require.ErrorIs(t, verifyCSRF(ctx), errorCSRFValidation)
+
+	ctx = newTestContext(http.MethodPost, "", csrf)
+	ctx.Request.Header.Set(csrfHeader, "other-value")
+	require.ErrorIs(t, verifyCSRF(ctx), errorCSRFValidation)
+
+	ctx = newTestContext(http.MethodPost, "", csrf)
+	ctx.Request.Header.Set(csrfHeader, "csrf-value")
+	require.NoError(t, verifyCSRF(ctx))
+}
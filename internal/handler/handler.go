@@ -1,28 +1,54 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/auth"
 	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/model"
-	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/repository/postgre"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/validation"
 	"github.com/gin-gonic/gin"
 	"io"
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 type repository interface {
-	Create(user model.User) error
-	UpdateOrder(login string, order model.Order) error
-	GetUser(login string) (model.User, error)
-	GetOrders(login string) ([]model.Order, error)
-	Withdraw(login string, withdraw model.Withdraw) error
-	GetWithdrawals(login string) ([]model.Withdraw, error)
+	Create(ctx context.Context, user model.User) error
+	UpdateOrder(ctx context.Context, login string, order model.Order) error
+	GetUser(ctx context.Context, login string) (model.User, error)
+	UpdatePassword(ctx context.Context, login, password string) error
+	GetOrders(ctx context.Context, login string) ([]model.Order, error)
+	GetBalance(ctx context.Context, login string) (model.Balance, error)
+	Withdraw(ctx context.Context, login string, withdraw model.Withdraw) error
+	GetWithdrawals(ctx context.Context, login string) ([]model.Withdraw, error)
+	SaveRefreshToken(ctx context.Context, login, hash string, expiresAt time.Time) error
 }
 
-func Register(storage repository) gin.HandlerFunc {
+type credentialValidator interface {
+	ValidateCredentials(user model.User) []validation.Violation
+}
+
+type validationErrors struct {
+	Errors []validation.Violation `json:"errors"`
+}
+
+type loginGuard interface {
+	Attempt(ctx context.Context, login, ip string) (time.Duration, error)
+	Release(ctx context.Context, login, ip string)
+	Succeed(ctx context.Context, login, ip string) error
+}
+
+type tokenManager interface {
+	TTL() time.Duration
+	GenerateToken(login string) (string, error)
+	ParseToken(rawToken string) (auth.AccessToken, error)
+	GenerateRefreshToken() (token, hash string, expiresAt time.Time, err error)
+}
+
+func Register(storage repository, tokens tokenManager, cookies CookieConfig, validator credentialValidator) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		bytes, err := io.ReadAll(ctx.Request.Body)
 		if err != nil {
@@ -39,35 +65,35 @@ func Register(storage repository) gin.HandlerFunc {
 			return
 		}
 
-		user.Password = auth.HashPass(user.Password)
-
-		_, err = storage.GetUser(user.Login)
-		if err == nil {
-			log.Println("Error: user with same login already exist")
-			ctx.Writer.WriteHeader(http.StatusConflict)
+		if violations := validator.ValidateCredentials(user); len(violations) > 0 {
+			log.Printf("Error: registration of %q rejected by %d validation rules", user.Login, len(violations))
+			writeValidationErrors(ctx, violations)
 			return
 		}
 
-		token, err := auth.GenerateToken(user.Login)
+		user.Password, err = auth.HashPass(user.Password)
 		if err != nil {
 			log.Println(err)
 			ctx.Writer.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		err = storage.Create(user)
-		if err != nil {
+		err = storage.Create(ctx.Request.Context(), user)
+		if errors.Is(err, model.ErrorConflict) {
 			log.Println(err)
-			ctx.Writer.WriteHeader(http.StatusInternalServerError)
+			ctx.Writer.WriteHeader(http.StatusConflict)
+			return
+		}
+		if err != nil {
+			writeStorageError(ctx, err)
 			return
 		}
 
-		ctx.Writer.Header().Add("Authorization", token)
-		ctx.Writer.WriteHeader(http.StatusOK)
+		issueTokens(ctx, storage, tokens, cookies, user.Login)
 	}
 }
 
-func Login(storage repository) gin.HandlerFunc {
+func Login(storage repository, tokens tokenManager, cookies CookieConfig, guard loginGuard) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		bytes, err := io.ReadAll(ctx.Request.Body)
 		if err != nil {
@@ -84,30 +110,108 @@ func Login(storage repository) gin.HandlerFunc {
 			return
 		}
 
-		user.Password = auth.HashPass(user.Password)
+		ip := ctx.ClientIP()
 
-		userDB, err := storage.GetUser(user.Login)
+		wait, err := guard.Attempt(ctx.Request.Context(), user.Login, ip)
 		if err != nil {
-			log.Println(err)
-			ctx.Writer.WriteHeader(http.StatusInternalServerError)
+			writeStorageError(ctx, err)
 			return
 		}
 
-		if user.Password != userDB.Password {
-			log.Println("Error: wrong login/password passed")
-			ctx.Writer.WriteHeader(http.StatusUnauthorized)
+		if wait > 0 {
+			log.Printf("Error: login %s from %s is locked out", user.Login, ip)
+			writeTooManyRequests(ctx, wait)
 			return
 		}
 
-		token, err := auth.GenerateToken(user.Login)
+		userDB, err := storage.GetUser(ctx.Request.Context(), user.Login)
+		if errors.Is(err, model.ErrorNotFound) {
+			// spend as much time as a wrong password would, so logins can't be enumerated
+			auth.CheckDummyPass(user.Password)
+			rejectLogin(ctx)
+			return
+		}
 		if err != nil {
+			guard.Release(ctx.Request.Context(), user.Login, ip)
+			writeStorageError(ctx, err)
+			return
+		}
+
+		ok, needsRehash, err := auth.CheckPass(userDB.Password, user.Password)
+		if err != nil {
+			guard.Release(ctx.Request.Context(), user.Login, ip)
 			log.Println(err)
 			ctx.Writer.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		ctx.Writer.Header().Add("Authorization", token)
-		ctx.Writer.WriteHeader(http.StatusOK)
+		if !ok {
+			rejectLogin(ctx)
+			return
+		}
+
+		if err := guard.Succeed(ctx.Request.Context(), user.Login, ip); err != nil {
+			log.Println(err)
+		}
+
+		if needsRehash {
+			rehashPassword(ctx.Request.Context(), storage, user)
+		}
+
+		issueTokens(ctx, storage, tokens, cookies, user.Login)
+	}
+}
+
+// rejectLogin answers unknown logins and wrong passwords alike, the attempt has been counted by the guard already.
+func rejectLogin(ctx *gin.Context) {
+	log.Println("Error: wrong login/password passed")
+	ctx.Writer.WriteHeader(http.StatusUnauthorized)
+}
+
+// writeStorageError answers 503 when the database is unreachable, so clients know to retry, and 500 otherwise.
+func writeStorageError(ctx *gin.Context, err error) {
+	log.Println(err)
+	if errors.Is(err, model.ErrorUnavailable) {
+		ctx.Writer.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	ctx.Writer.WriteHeader(http.StatusInternalServerError)
+}
+
+func writeValidationErrors(ctx *gin.Context, violations []validation.Violation) {
+	bytes, err := json.Marshal(validationErrors{Errors: violations})
+	if err != nil {
+		log.Println(err)
+		ctx.Writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	ctx.Writer.Header().Add("Content-Type", "application/json")
+	ctx.Writer.WriteHeader(http.StatusBadRequest)
+
+	_, err = ctx.Writer.Write(bytes)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func writeTooManyRequests(ctx *gin.Context, wait time.Duration) {
+	seconds := int64((wait + time.Second - 1) / time.Second)
+	ctx.Writer.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	ctx.Writer.WriteHeader(http.StatusTooManyRequests)
+}
+
+// rehashPassword upgrades a legacy or outdated hash, failures are logged and don't block the login.
+func rehashPassword(ctx context.Context, storage repository, user model.User) {
+	hash, err := auth.HashPass(user.Password)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = storage.UpdatePassword(ctx, user.Login, hash)
+	if err != nil {
+		log.Println(err)
 	}
 }
 
@@ -175,16 +279,21 @@ func UpdateOrder(storage repository) gin.HandlerFunc {
 			Number: number,
 		}
 
-		err = storage.UpdateOrder(login, order)
-		if err != nil {
+		err = storage.UpdateOrder(ctx.Request.Context(), login, order)
+		if errors.Is(err, model.ErrorOrderUploaded) {
 			log.Println(err)
-			if errors.Is(err, postgre.ErrorConflict) {
-				ctx.Writer.WriteHeader(http.StatusConflict)
-				return
-			}
 			ctx.Writer.WriteHeader(http.StatusOK)
 			return
 		}
+		if errors.Is(err, model.ErrorOrderOfAnotherUser) {
+			log.Println(err)
+			ctx.Writer.WriteHeader(http.StatusConflict)
+			return
+		}
+		if err != nil {
+			writeStorageError(ctx, err)
+			return
+		}
 
 		ctx.Writer.WriteHeader(http.StatusAccepted)
 	}
@@ -206,10 +315,9 @@ func GetOrders(storage repository) gin.HandlerFunc {
 			return
 		}
 
-		batch, err := storage.GetOrders(login)
+		batch, err := storage.GetOrders(ctx.Request.Context(), login)
 		if err != nil {
-			log.Println(err)
-			ctx.Writer.WriteHeader(http.StatusInternalServerError)
+			writeStorageError(ctx, err)
 			return
 		}
 
@@ -239,39 +347,6 @@ func GetOrders(storage repository) gin.HandlerFunc {
 	}
 }
 
-type balance struct {
-	Current   float64 `json:"current"`
-	Withdrawn float64 `json:"withdrawn"`
-}
-
-func calcBalance(storage repository, login string) (balance, error) {
-	orders, err := storage.GetOrders(login)
-	if err != nil {
-		return balance{}, err
-	}
-
-	var bal balance
-
-	for _, order := range orders {
-		if order.Accrual != nil {
-			bal.Current += *order.Accrual
-		}
-	}
-
-	withdrawals, err := storage.GetWithdrawals(login)
-	if err != nil {
-		return balance{}, err
-	}
-
-	for _, w := range withdrawals {
-		bal.Withdrawn += w.Sum
-	}
-
-	bal.Current -= bal.Withdrawn
-
-	return bal, nil
-}
-
 func GetBalance(storage repository) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		l, ok := ctx.Get("Login")
@@ -288,10 +363,9 @@ func GetBalance(storage repository) gin.HandlerFunc {
 			return
 		}
 
-		bal, err := calcBalance(storage, login)
+		bal, err := storage.GetBalance(ctx.Request.Context(), login)
 		if err != nil {
-			log.Println(err)
-			ctx.Writer.WriteHeader(http.StatusInternalServerError)
+			writeStorageError(ctx, err)
 			return
 		}
 
@@ -346,16 +420,9 @@ func Withdraw(storage repository) gin.HandlerFunc {
 			return
 		}
 
-		bal, err := calcBalance(storage, login)
-		if err != nil {
-			log.Println(err)
-			ctx.Writer.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		if bal.Current < w.Sum {
-			log.Println("Error: withdrawal sum is bigger than current balance")
-			ctx.Writer.WriteHeader(http.StatusPaymentRequired)
+		if w.Sum <= 0 {
+			log.Println("Error: withdrawal sum must be positive")
+			ctx.Writer.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
@@ -372,10 +439,19 @@ func Withdraw(storage repository) gin.HandlerFunc {
 			return
 		}
 
-		err = storage.Withdraw(login, w)
-		if err != nil {
+		err = storage.Withdraw(ctx.Request.Context(), login, w)
+		if errors.Is(err, model.ErrorInsufficientFunds) {
 			log.Println(err)
-			ctx.Writer.WriteHeader(http.StatusInternalServerError)
+			ctx.Writer.WriteHeader(http.StatusPaymentRequired)
+			return
+		}
+		if errors.Is(err, model.ErrorWithdrawExists) {
+			log.Println(err)
+			ctx.Writer.WriteHeader(http.StatusConflict)
+			return
+		}
+		if err != nil {
+			writeStorageError(ctx, err)
 			return
 		}
 
@@ -399,10 +475,9 @@ func GetWithdrawals(storage repository) gin.HandlerFunc {
 			return
 		}
 
-		withdrawals, err := storage.GetWithdrawals(login)
+		withdrawals, err := storage.GetWithdrawals(ctx.Request.Context(), login)
 		if err != nil {
-			log.Println(err)
-			ctx.Writer.WriteHeader(http.StatusInternalServerError)
+			writeStorageError(ctx, err)
 			return
 		}
 
@@ -0,0 +1,256 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/auth"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/model"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/validation"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+type fakeRepository struct {
+	repository
+
+	users      map[string]model.User
+	getUserErr error
+	createErr  error
+}
+
+func (r *fakeRepository) GetUser(_ context.Context, login string) (model.User, error) {
+	if r.getUserErr != nil {
+		return model.User{}, r.getUserErr
+	}
+
+	user, ok := r.users[login]
+	if !ok {
+		return model.User{}, model.ErrorNotFound
+	}
+	return user, nil
+}
+
+func (r *fakeRepository) Create(_ context.Context, user model.User) error {
+	if r.createErr != nil {
+		return r.createErr
+	}
+
+	if _, ok := r.users[user.Login]; ok {
+		return model.ErrorUserExists
+	}
+
+	r.users[user.Login] = user
+	return nil
+}
+
+func (r *fakeRepository) UpdatePassword(_ context.Context, login, password string) error {
+	user := r.users[login]
+	user.Password = password
+	r.users[login] = user
+	return nil
+}
+
+func (r *fakeRepository) SaveRefreshToken(context.Context, string, string, time.Time) error {
+	return nil
+}
+
+func newTestTokenManager(t *testing.T) *auth.TokenManager {
+	t.Helper()
+
+	keys, err := auth.NewKeySet([]auth.Key{{ID: "k1", Secret: []byte("Ce45L1mMzQw5w09z")}})
+	require.NoError(t, err)
+
+	return auth.NewTokenManager(keys, time.Hour, auth.DefaultRefreshTTL, auth.DefaultIssuer, auth.DefaultAudience)
+}
+
+func newTestRepository(t *testing.T) *fakeRepository {
+	t.Helper()
+
+	hash, err := auth.HashPass("Secret123")
+	require.NoError(t, err)
+
+	return &fakeRepository{
+		users: map[string]model.User{"gopher": {Login: "gopher", Password: hash}},
+	}
+}
+
+func serve(h gin.HandlerFunc, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/api/user/", strings.NewReader(body))
+
+	h(ctx)
+	ctx.Writer.WriteHeaderNow()
+	return w
+}
+
+var dbDown = errors.Join(model.ErrorUnavailable, errors.New("dial tcp: connection refused"))
+
+func TestRegister(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		createErr  error
+		wantStatus int
+	}{
+		{
+			name:       "created",
+			body:       `{"login":"newbie","password":"Secret123"}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "login_taken",
+			body:       `{"login":"gopher","password":"Secret123"}`,
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "invalid_credentials",
+			body:       `{"login":"","password":""}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "malformed_body",
+			body:       `{"login":`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "database_down",
+			body:       `{"login":"newbie","password":"Secret123"}`,
+			createErr:  dbDown,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "database_error",
+			body:       `{"login":"newbie","password":"Secret123"}`,
+			createErr:  errors.New("syntax error"),
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := newTestRepository(t)
+			storage.createErr = tt.createErr
+
+			h := Register(storage, newTestTokenManager(t), CookieConfig{}, validation.DefaultCredentialPolicy())
+			w := serve(h, tt.body)
+			require.Equal(t, tt.wantStatus, w.Code)
+		})
+	}
+}
+
+func TestLogin(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		getUserErr error
+		wantStatus int
+	}{
+		{
+			name:       "ok",
+			body:       `{"login":"gopher","password":"Secret123"}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "wrong_password",
+			body:       `{"login":"gopher","password":"Secret1234"}`,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "unknown_user",
+			body:       `{"login":"stranger","password":"Secret123"}`,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "long_login",
+			body:       `{"login":"` + strings.Repeat("x", 1000) + `","password":"Secret123"}`,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "database_down",
+			body:       `{"login":"gopher","password":"Secret123"}`,
+			getUserErr: dbDown,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "database_error",
+			body:       `{"login":"gopher","password":"Secret123"}`,
+			getUserErr: errors.New("syntax error"),
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := newTestRepository(t)
+			storage.getUserErr = tt.getUserErr
+
+			guard := auth.NewLoginGuard(auth.NewMemoryAttemptStore(), auth.DefaultLoginLockout, auth.DefaultIPLockout)
+			h := Login(storage, newTestTokenManager(t), CookieConfig{}, guard)
+
+			w := serve(h, tt.body)
+			require.Equal(t, tt.wantStatus, w.Code)
+		})
+	}
+}
+
+func TestLogin_LockedOut(t *testing.T) {
+	storage := newTestRepository(t)
+	guard := auth.NewLoginGuard(auth.NewMemoryAttemptStore(), auth.LockoutPolicy{
+		FreeAttempts: 1,
+		BaseDelay:    time.Minute,
+		MaxDelay:     time.Hour,
+		Window:       time.Hour,
+	}, auth.DefaultIPLockout)
+	h := Login(storage, newTestTokenManager(t), CookieConfig{}, guard)
+
+	for i := 0; i < 2; i++ {
+		w := serve(h, `{"login":"stranger","password":"Secret123"}`)
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+
+	w := serve(h, `{"login":"stranger","password":"Secret123"}`)
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "60", w.Header().Get("Retry-After"))
+}
+
+func TestLogin_SpoofedForwardedFor(t *testing.T) {
+	storage := newTestRepository(t)
+	guard := auth.NewLoginGuard(auth.NewMemoryAttemptStore(), auth.DefaultLoginLockout, auth.LockoutPolicy{
+		FreeAttempts: 1,
+		BaseDelay:    time.Minute,
+		MaxDelay:     time.Hour,
+		Window:       time.Hour,
+	})
+
+	router := gin.New()
+	require.NoError(t, router.SetTrustedProxies(nil))
+	router.POST("/api/user/login", Login(storage, newTestTokenManager(t), CookieConfig{}, guard))
+
+	login := func(user, forwardedFor string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/api/user/login", strings.NewReader(`{"login":"`+user+`","password":"Secret123"}`))
+		r.Header.Set("X-Forwarded-For", forwardedFor)
+		r.Header.Set("X-Real-IP", forwardedFor)
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	require.Equal(t, http.StatusUnauthorized, login("stranger1", "203.0.113.1").Code)
+	require.Equal(t, http.StatusUnauthorized, login("stranger2", "203.0.113.2").Code)
+
+	w := login("stranger3", "203.0.113.3")
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "60", w.Header().Get("Retry-After"))
+
+	require.Equal(t, http.StatusTooManyRequests, login("gopher", "203.0.113.4").Code)
+}
@@ -0,0 +1,40 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/worker"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+)
+
+type healthReporter interface {
+	Health() worker.Health
+}
+
+// Health answers 200 while the accrual scheduler is leasing jobs and 503 while the storage keeps failing it.
+func Health(pool healthReporter) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		health := pool.Health()
+
+		bytes, err := json.Marshal(&health)
+		if err != nil {
+			log.Println(err)
+			ctx.Writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		status := http.StatusOK
+		if !health.Healthy {
+			status = http.StatusServiceUnavailable
+		}
+
+		ctx.Writer.Header().Add("Content-Type", "application/json")
+		ctx.Writer.WriteHeader(status)
+
+		_, err = ctx.Writer.Write(bytes)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/worker"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakeHealth worker.Health
+
+func (h fakeHealth) Health() worker.Health {
+	return worker.Health(h)
+}
+
+func TestHealth(t *testing.T) {
+	tests := []struct {
+		name   string
+		health worker.Health
+		want   int
+	}{
+		{
+			name:   "healthy",
+			health: worker.Health{Healthy: true, LastLeaseAt: time.Now()},
+			want:   http.StatusOK,
+		},
+		{
+			name:   "storage failing",
+			health: worker.Health{LastErrorAt: time.Now(), ConsecutiveFailures: 3},
+			want:   http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.GET("/health", Health(fakeHealth(tt.health)))
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+			require.Equal(t, tt.want, w.Code)
+			require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+			var got worker.Health
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+			require.Equal(t, tt.health.Healthy, got.Healthy)
+			require.Equal(t, tt.health.ConsecutiveFailures, got.ConsecutiveFailures)
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/model"
+	"github.com/gin-gonic/gin"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+	replayedHeader    = "Idempotent-Replayed"
+	maxIdempotencyKey = 255
+
+	IdempotencyTTL = 24 * time.Hour
+
+	// a key stays reserved for pendingTTL at most, so a request lost mid-way doesn't block its retries for a day
+	pendingTTL = time.Minute
+	// a retry waits for the request in progress with the same key for pendingWait, then gets 409
+	pendingWait = 5 * time.Second
+	pendingPoll = 50 * time.Millisecond
+)
+
+type idempotencyRepository interface {
+	ReserveIdempotencyKey(ctx context.Context, login, key, requestHash string, ttl time.Duration) (model.IdempotentResponse, bool, error)
+	ReleaseIdempotencyKey(ctx context.Context, login, key string) error
+	SaveIdempotentResponse(ctx context.Context, login, key string, resp model.IdempotentResponse, ttl time.Duration) error
+}
+
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *recordingWriter) Write(data []byte) (int, error) {
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
+
+func (r *recordingWriter) WriteString(s string) (int, error) {
+	r.body.WriteString(s)
+	return r.ResponseWriter.WriteString(s)
+}
+
+// IdempotencyMiddleware replays the stored response when a client retries a request with the same Idempotency-Key.
+// The key is reserved before the request runs, a retry arriving meanwhile waits for its response.
+func IdempotencyMiddleware(storage idempotencyRepository) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		key := ctx.GetHeader(idempotencyHeader)
+		if key == "" {
+			ctx.Next()
+			return
+		}
+
+		if len(key) > maxIdempotencyKey {
+			log.Println("Error: idempotency key is too long")
+			ctx.Writer.WriteHeader(http.StatusBadRequest)
+			ctx.Abort()
+			return
+		}
+
+		login := ctx.GetString("Login")
+		if login == "" {
+			log.Println("Couldn't get Login value from context")
+			ctx.Writer.WriteHeader(http.StatusInternalServerError)
+			ctx.Abort()
+			return
+		}
+
+		body, err := io.ReadAll(ctx.Request.Body)
+		if err != nil {
+			log.Println(err)
+			ctx.Writer.WriteHeader(http.StatusInternalServerError)
+			ctx.Abort()
+			return
+		}
+		ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		sum := sha256.Sum256(body)
+		requestHash := hex.EncodeToString(sum[:])
+
+		reserved, err := waitIdempotencyKey(ctx, storage, login, key, requestHash)
+		if err != nil {
+			writeStorageError(ctx, err)
+			ctx.Abort()
+			return
+		}
+		if !reserved {
+			ctx.Abort()
+			return
+		}
+
+		recorder := &recordingWriter{ResponseWriter: ctx.Writer}
+		ctx.Writer = recorder
+		ctx.Next()
+		ctx.Writer = recorder.ResponseWriter
+
+		status := recorder.Status()
+		if status >= http.StatusInternalServerError {
+			err = storage.ReleaseIdempotencyKey(context.Background(), login, key)
+			if err != nil {
+				log.Println(err)
+			}
+			return
+		}
+
+		err = storage.SaveIdempotentResponse(context.Background(), login, key, model.IdempotentResponse{
+			RequestHash: requestHash,
+			StatusCode:  status,
+			ContentType: recorder.Header().Get("Content-Type"),
+			Body:        recorder.body.Bytes(),
+		}, IdempotencyTTL)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// waitIdempotencyKey reserves the key for the request. When it's taken, it answers with the stored
+// response, 422 for another request body or 409 when the request holding the key doesn't finish in time.
+func waitIdempotencyKey(ctx *gin.Context, storage idempotencyRepository, login, key, requestHash string) (bool, error) {
+	deadline := time.Now().Add(pendingWait)
+
+	for {
+		stored, reserved, err := storage.ReserveIdempotencyKey(ctx.Request.Context(), login, key, requestHash, pendingTTL)
+		if err != nil || reserved {
+			return reserved, err
+		}
+
+		if stored.RequestHash != requestHash {
+			log.Println("Error: idempotency key reused with a different request body")
+			ctx.Writer.WriteHeader(http.StatusUnprocessableEntity)
+			return false, nil
+		}
+
+		if !stored.Pending() {
+			replay(ctx, stored)
+			return false, nil
+		}
+
+		if time.Now().After(deadline) {
+			log.Println("Error: request with the same idempotency key is in progress")
+			ctx.Writer.WriteHeader(http.StatusConflict)
+			return false, nil
+		}
+
+		select {
+		case <-time.After(pendingPoll):
+		case <-ctx.Request.Context().Done():
+			return false, ctx.Request.Context().Err()
+		}
+	}
+}
+
+func replay(ctx *gin.Context, stored model.IdempotentResponse) {
+	if stored.ContentType != "" {
+		ctx.Writer.Header().Set("Content-Type", stored.ContentType)
+	}
+	ctx.Writer.Header().Set(replayedHeader, "true")
+	ctx.Writer.WriteHeader(stored.StatusCode)
+
+	_, err := ctx.Writer.Write(stored.Body)
+	if err != nil {
+		log.Println(err)
+	}
+}
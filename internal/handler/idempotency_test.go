@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/repository/memory"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newIdempotentRouter(storage *memory.Storage, h gin.HandlerFunc) *gin.Engine {
+	router := gin.New()
+	router.POST("/withdraw", func(ctx *gin.Context) { ctx.Set("Login", "gopher") }, IdempotencyMiddleware(storage), h)
+	return router
+}
+
+func postWithKey(router *gin.Engine, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/withdraw", strings.NewReader(body))
+	req.Header.Set(idempotencyHeader, key)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestIdempotencyMiddleware_Concurrent(t *testing.T) {
+	const requests = 10
+
+	var calls atomic.Int32
+	router := newIdempotentRouter(memory.NewStorage(), func(ctx *gin.Context) {
+		calls.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		ctx.String(http.StatusOK, "done")
+	})
+
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, requests)
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = postWithKey(router, "key", `{"order":"2377225624","sum":751}`)
+		}(i)
+	}
+	wg.Wait()
+
+	require.Equal(t, int32(1), calls.Load())
+
+	var replayed int
+	for _, w := range responses {
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "done", w.Body.String())
+		if w.Header().Get(replayedHeader) == "true" {
+			replayed++
+		}
+	}
+	require.Equal(t, requests-1, replayed)
+
+	w := postWithKey(router, "key", `{"order":"2377225624","sum":1}`)
+	require.Equal(t, http.StatusUnprocessableEntity, w.Code)
+}
+
+func TestIdempotencyMiddleware_ServerError(t *testing.T) {
+	var calls atomic.Int32
+	router := newIdempotentRouter(memory.NewStorage(), func(ctx *gin.Context) {
+		if calls.Add(1) == 1 {
+			ctx.Status(http.StatusInternalServerError)
+			return
+		}
+		ctx.String(http.StatusOK, "done")
+	})
+
+	// a failed request releases the key, its retry runs again
+	require.Equal(t, http.StatusInternalServerError, postWithKey(router, "key", "{}").Code)
+	require.Equal(t, http.StatusOK, postWithKey(router, "key", "{}").Code)
+	require.Equal(t, http.StatusOK, postWithKey(router, "key", "{}").Code)
+	require.Equal(t, int32(2), calls.Load())
+}
@@ -2,26 +2,77 @@ package handler
 
 import (
 	"compress/gzip"
-	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/auth"
+	"context"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"io"
 	"log"
 	"net/http"
 	"strings"
+	"time"
 )
 
-func AuthMiddleware(ctx *gin.Context) {
-	authHeader := ctx.GetHeader("Authorization")
+type revocationChecker interface {
+	IsAccessTokenRevoked(ctx context.Context, jti, login string, issuedAt time.Time) (bool, error)
+}
 
-	login, err := auth.ParseToken(authHeader)
-	if err != nil {
-		log.Println("wrong authorization header provided")
-		ctx.Writer.WriteHeader(http.StatusUnauthorized)
-		ctx.Abort()
-		return
+func AuthMiddleware(tokens tokenManager, storage revocationChecker, cookies CookieConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		rawToken, fromCookie, err := extractToken(ctx, cookies)
+		if errors.Is(err, errorNoToken) {
+			log.Println(err)
+			writeAuthError(ctx, http.StatusUnauthorized, "", err)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			writeAuthError(ctx, http.StatusBadRequest, "invalid_request", err)
+			return
+		}
+
+		token, err := tokens.ParseToken(rawToken)
+		if err != nil {
+			log.Println("wrong authorization header provided:", err)
+			writeAuthError(ctx, http.StatusUnauthorized, "invalid_token", err)
+			return
+		}
+
+		if fromCookie {
+			if err := verifyCSRF(ctx); err != nil {
+				log.Println(err)
+				ctx.Writer.WriteHeader(http.StatusForbidden)
+				ctx.Abort()
+				return
+			}
+		}
+
+		revoked, err := storage.IsAccessTokenRevoked(ctx.Request.Context(), token.ID, token.Login, token.IssuedAt)
+		if err != nil {
+			writeStorageError(ctx, err)
+			ctx.Abort()
+			return
+		}
+
+		if revoked {
+			log.Println("Error: revoked token provided")
+			writeAuthError(ctx, http.StatusUnauthorized, "invalid_token", errors.New("token is revoked"))
+			return
+		}
+
+		ctx.Set("Login", token.Login)
+		ctx.Set("Token", token)
 	}
+}
 
-	ctx.Set("Login", login)
+// TimeoutMiddleware bounds the request context so storage queries are aborted once the deadline passes.
+func TimeoutMiddleware(timeout time.Duration) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		timeoutCtx, cancel := context.WithTimeout(ctx.Request.Context(), timeout)
+		defer cancel()
+
+		ctx.Request = ctx.Request.WithContext(timeoutCtx)
+		ctx.Next()
+	}
 }
 
 type gzipWriter struct {
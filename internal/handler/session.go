@@ -0,0 +1,236 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/auth"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/model"
+	"github.com/gin-gonic/gin"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+type sessionRepository interface {
+	RotateRefreshToken(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (login string, err error)
+	RevokeRefreshToken(ctx context.Context, login, hash string) error
+	RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error
+	RevokeAllTokens(ctx context.Context, login string) error
+}
+
+type refreshTokenSaver interface {
+	SaveRefreshToken(ctx context.Context, login, hash string, expiresAt time.Time) error
+}
+
+type tokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// issueTokens responds with a new access token in the Authorization header
+// and the access/refresh token pair in the body.
+func issueTokens(ctx *gin.Context, storage refreshTokenSaver, tokens tokenManager, cookies CookieConfig, login string) {
+	refreshToken, hash, expiresAt, err := tokens.GenerateRefreshToken()
+	if err != nil {
+		log.Println(err)
+		ctx.Writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = storage.SaveRefreshToken(ctx.Request.Context(), login, hash, expiresAt)
+	if err != nil {
+		writeStorageError(ctx, err)
+		return
+	}
+
+	writeTokenPair(ctx, tokens, cookies, login, refreshToken, expiresAt)
+}
+
+func writeTokenPair(ctx *gin.Context, tokens tokenManager, cookies CookieConfig, login, refreshToken string, refreshExpiresAt time.Time) {
+	token, err := tokens.GenerateToken(login)
+	if err != nil {
+		log.Println(err)
+		ctx.Writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if cookies.Enabled {
+		err = setSessionCookies(ctx, cookies, token, tokens.TTL(), refreshToken, refreshExpiresAt)
+		if err != nil {
+			log.Println(err)
+			ctx.Writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	bytes, err := json.Marshal(tokenPair{
+		AccessToken:  token,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(tokens.TTL().Seconds()),
+	})
+	if err != nil {
+		log.Println(err)
+		ctx.Writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	ctx.Writer.Header().Add("Authorization", token)
+	ctx.Writer.Header().Add("Content-Type", "application/json")
+	ctx.Writer.Header().Add("Cache-Control", "no-store")
+	ctx.Writer.WriteHeader(http.StatusOK)
+
+	_, err = ctx.Writer.Write(bytes)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func readRefreshRequest(ctx *gin.Context) (refreshRequest, error) {
+	var req refreshRequest
+
+	bytes, err := io.ReadAll(ctx.Request.Body)
+	if err != nil {
+		return refreshRequest{}, err
+	}
+
+	if len(bytes) == 0 {
+		return req, nil
+	}
+
+	err = json.Unmarshal(bytes, &req)
+	return req, err
+}
+
+func RefreshToken(storage sessionRepository, tokens tokenManager, cookies CookieConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		req, err := readRefreshRequest(ctx)
+		if err != nil {
+			log.Println(err)
+			ctx.Writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if req.RefreshToken == "" && cookies.Enabled {
+			req.RefreshToken, _ = ctx.Cookie(refreshCookie)
+			if req.RefreshToken != "" {
+				if err := verifyCSRF(ctx); err != nil {
+					log.Println(err)
+					ctx.Writer.WriteHeader(http.StatusForbidden)
+					return
+				}
+			}
+		}
+
+		if req.RefreshToken == "" {
+			log.Println("Error: refresh token is not provided")
+			ctx.Writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		refreshToken, hash, expiresAt, err := tokens.GenerateRefreshToken()
+		if err != nil {
+			log.Println(err)
+			ctx.Writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		login, err := storage.RotateRefreshToken(ctx.Request.Context(), auth.HashRefreshToken(req.RefreshToken), hash, expiresAt)
+		if errors.Is(err, model.ErrorRefreshTokenInvalid) {
+			log.Println(err)
+			ctx.Writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			writeStorageError(ctx, err)
+			return
+		}
+
+		writeTokenPair(ctx, tokens, cookies, login, refreshToken, expiresAt)
+	}
+}
+
+// Logout revokes the access token used for the request and, when provided, the refresh token of the session.
+func Logout(storage sessionRepository, cookies CookieConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		token, ok := accessTokenFromContext(ctx)
+		if !ok {
+			log.Println("Couldn't get Token value from context")
+			ctx.Writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		req, err := readRefreshRequest(ctx)
+		if err != nil {
+			log.Println(err)
+			ctx.Writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		err = storage.RevokeAccessToken(ctx.Request.Context(), token.ID, token.ExpiresAt)
+		if err != nil {
+			writeStorageError(ctx, err)
+			return
+		}
+
+		if req.RefreshToken == "" && cookies.Enabled {
+			req.RefreshToken, _ = ctx.Cookie(refreshCookie)
+		}
+
+		if req.RefreshToken != "" {
+			err = storage.RevokeRefreshToken(ctx.Request.Context(), token.Login, auth.HashRefreshToken(req.RefreshToken))
+			if err != nil {
+				writeStorageError(ctx, err)
+				return
+			}
+		}
+
+		if cookies.Enabled {
+			clearSessionCookies(ctx, cookies)
+		}
+
+		ctx.Writer.WriteHeader(http.StatusOK)
+	}
+}
+
+// LogoutAll ends every session of the user on every device.
+func LogoutAll(storage sessionRepository, cookies CookieConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		token, ok := accessTokenFromContext(ctx)
+		if !ok {
+			log.Println("Couldn't get Token value from context")
+			ctx.Writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		err := storage.RevokeAllTokens(ctx.Request.Context(), token.Login)
+		if err != nil {
+			writeStorageError(ctx, err)
+			return
+		}
+
+		if cookies.Enabled {
+			clearSessionCookies(ctx, cookies)
+		}
+
+		ctx.Writer.WriteHeader(http.StatusOK)
+	}
+}
+
+func accessTokenFromContext(ctx *gin.Context) (auth.AccessToken, bool) {
+	t, ok := ctx.Get("Token")
+	if !ok {
+		return auth.AccessToken{}, false
+	}
+
+	token, ok := t.(auth.AccessToken)
+	return token, ok
+}
@@ -0,0 +1,24 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors reported by every storage implementation, so handlers and workers
+// don't depend on a particular database driver.
+var (
+	ErrorNotFound    = errors.New("error: not found")
+	ErrorConflict    = errors.New("error: already exists")
+	ErrorUnavailable = errors.New("error: storage is unavailable")
+)
+
+var (
+	ErrorUserExists          = fmt.Errorf("%w: user with same login already exists", ErrorConflict)
+	ErrorOrderOfAnotherUser  = fmt.Errorf("%w: order was uploaded by another user", ErrorConflict)
+	ErrorOrderUploaded       = errors.New("error: already was uploaded")
+	ErrorOrderTransition     = fmt.Errorf("%w: illegal order status transition", ErrorConflict)
+	ErrorInsufficientFunds   = errors.New("error: insufficient funds")
+	ErrorWithdrawExists      = fmt.Errorf("%w: withdrawal for this order already exists", ErrorConflict)
+	ErrorRefreshTokenInvalid = errors.New("error: refresh token is invalid")
+)
@@ -11,19 +11,81 @@ type User struct {
 
 const (
 	OrderStatusNew        = "NEW"
-	OrderStatusRegistered = "REGISTERED"
 	OrderStatusProcessing = "PROCESSING"
+	OrderStatusInvalid    = "INVALID"
+	OrderStatusProcessed  = "PROCESSED"
 )
 
+// orderTransitions lists the statuses an order may move to, INVALID and PROCESSED are final.
+var orderTransitions = map[string][]string{
+	OrderStatusNew:        {OrderStatusNew, OrderStatusProcessing, OrderStatusInvalid, OrderStatusProcessed},
+	OrderStatusProcessing: {OrderStatusProcessing, OrderStatusInvalid, OrderStatusProcessed},
+}
+
+// CanTransitOrder reports whether an order in status from may be updated to status to.
+func CanTransitOrder(from, to string) bool {
+	for _, status := range orderTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+// IsFinalOrderStatus reports whether the accrual of an order in this status won't change anymore.
+func IsFinalOrderStatus(status string) bool {
+	return status == OrderStatusInvalid || status == OrderStatusProcessed
+}
+
 type Order struct {
 	Number     string    `json:"number"`
 	Status     string    `json:"status"`
-	Accrual    *float64  `json:"accrual,omitempty"`
+	Accrual    *Money    `json:"accrual,omitempty"`
 	UploadedAt time.Time `json:"uploaded_at"`
 }
 
 type Withdraw struct {
 	Order       string     `json:"order"`
-	Sum         float64    `json:"sum"`
+	Sum         Money      `json:"sum"`
 	ProcessedAt *time.Time `json:"processed_at,omitempty"`
 }
+
+type Balance struct {
+	Current   Money `json:"current"`
+	Withdrawn Money `json:"withdrawn"`
+}
+
+type IdempotentResponse struct {
+	RequestHash string
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
+
+// Pending reports a key reserved by a request that hasn't finished yet.
+func (r IdempotentResponse) Pending() bool {
+	return r.StatusCode == 0
+}
+
+// LoginAttempts counts recent failed logins for a login name or a client address.
+type LoginAttempts struct {
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   time.Time
+}
+
+// LockoutEvent is the audit record of a temporary login lockout.
+type LockoutEvent struct {
+	Key         string
+	Login       string
+	IP          string
+	Failures    int
+	LockedUntil time.Time
+	CreatedAt   time.Time
+}
+
+// AccrualJob is a pending poll of the accrual system for an order that hasn't reached a final status.
+type AccrualJob struct {
+	Order    Order
+	Attempts int // polls leased so far, including the current one
+}
@@ -0,0 +1,31 @@
+package model
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestCanTransitOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		from string
+		to   string
+		want bool
+	}{
+		{name: "new_to_new", from: OrderStatusNew, to: OrderStatusNew, want: true},
+		{name: "new_to_processing", from: OrderStatusNew, to: OrderStatusProcessing, want: true},
+		{name: "new_to_invalid", from: OrderStatusNew, to: OrderStatusInvalid, want: true},
+		{name: "new_to_processed", from: OrderStatusNew, to: OrderStatusProcessed, want: true},
+		{name: "processing_to_processed", from: OrderStatusProcessing, to: OrderStatusProcessed, want: true},
+		{name: "processing_to_invalid", from: OrderStatusProcessing, to: OrderStatusInvalid, want: true},
+		{name: "processing_to_new", from: OrderStatusProcessing, to: OrderStatusNew},
+		{name: "processed_is_final", from: OrderStatusProcessed, to: OrderStatusProcessed},
+		{name: "invalid_is_final", from: OrderStatusInvalid, to: OrderStatusProcessed},
+		{name: "unknown_status", from: OrderStatusNew, to: "REGISTERED"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, CanTransitOrder(tt.from, tt.to))
+		})
+	}
+}
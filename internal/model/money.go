@@ -0,0 +1,92 @@
+package model
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+)
+
+// Money is an amount of loyalty points stored as an integer number of hundredths,
+// so balances add up exactly. On the wire it stays a plain decimal number.
+type Money int64
+
+const moneyScale = 100
+
+var ErrorMoneyOverflow = errors.New("error: money amount is out of range")
+
+func ParseMoney(s string) (Money, error) {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return 0, fmt.Errorf("error: invalid money amount %q", s)
+	}
+
+	r.Mul(r, big.NewRat(moneyScale, 1))
+
+	// round half away from zero
+	num := new(big.Int).Set(r.Num())
+	den := r.Denom()
+	quo, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	if rem.Sign() != 0 && new(big.Int).Mul(new(big.Int).Abs(rem), big.NewInt(2)).Cmp(den) >= 0 {
+		quo.Add(quo, big.NewInt(int64(num.Sign())))
+	}
+
+	if !quo.IsInt64() {
+		return 0, ErrorMoneyOverflow
+	}
+
+	return Money(quo.Int64()), nil
+}
+
+func (m Money) String() string {
+	v := int64(m)
+	sign := ""
+	if v < 0 {
+		sign = "-"
+	}
+
+	units := uint64(v)
+	if v < 0 {
+		units = uint64(-v)
+	}
+
+	whole, frac := units/moneyScale, units%moneyScale
+	switch {
+	case frac == 0:
+		return sign + strconv.FormatUint(whole, 10)
+	case frac%10 == 0:
+		return fmt.Sprintf("%s%d.%d", sign, whole, frac/10)
+	default:
+		return fmt.Sprintf("%s%d.%02d", sign, whole, frac)
+	}
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *Money) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	var number json.Number
+	if err := json.Unmarshal(data, &number); err != nil {
+		return err
+	}
+
+	v, err := ParseMoney(number.String())
+	if err != nil {
+		return err
+	}
+
+	*m = v
+	return nil
+}
+
+// Value stores the amount as integer hundredths regardless of the query protocol.
+func (m Money) Value() (driver.Value, error) {
+	return int64(m), nil
+}
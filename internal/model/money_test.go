@@ -0,0 +1,133 @@
+package model
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		money   Money
+		wantErr bool
+	}{
+		{
+			name:  "integer",
+			value: "500",
+			money: 50000,
+		},
+		{
+			name:  "fraction",
+			value: "729.98",
+			money: 72998,
+		},
+		{
+			name:  "one_digit_fraction",
+			value: "0.1",
+			money: 10,
+		},
+		{
+			name:  "round_half_up",
+			value: "0.005",
+			money: 1,
+		},
+		{
+			name:  "round_down",
+			value: "0.0049",
+			money: 0,
+		},
+		{
+			name:  "negative_round_half",
+			value: "-0.005",
+			money: -1,
+		},
+		{
+			name:  "exponent",
+			value: "1.5e2",
+			money: 15000,
+		},
+		{
+			name:    "garbage",
+			value:   "ten",
+			wantErr: true,
+		},
+		{
+			name:    "overflow",
+			value:   "1e30",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			money, err := ParseMoney(tt.value)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.money, money)
+		})
+	}
+}
+
+func TestMoney_JSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		money Money
+		json  string
+	}{
+		{
+			name:  "zero",
+			money: 0,
+			json:  "0",
+		},
+		{
+			name:  "integer",
+			money: 50000,
+			json:  "500",
+		},
+		{
+			name:  "one_digit_fraction",
+			money: 50050,
+			json:  "500.5",
+		},
+		{
+			name:  "two_digit_fraction",
+			money: 72998,
+			json:  "729.98",
+		},
+		{
+			name:  "leading_zero_fraction",
+			money: 5,
+			json:  "0.05",
+		},
+		{
+			name:  "negative",
+			money: -1050,
+			json:  "-10.5",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bytes, err := json.Marshal(tt.money)
+			require.NoError(t, err)
+			require.Equal(t, tt.json, string(bytes))
+
+			var money Money
+			require.NoError(t, json.Unmarshal(bytes, &money))
+			require.Equal(t, tt.money, money)
+		})
+	}
+}
+
+func TestMoney_ExactArithmetic(t *testing.T) {
+	var a, b Money
+	require.NoError(t, json.Unmarshal([]byte("0.1"), &a))
+	require.NoError(t, json.Unmarshal([]byte("0.2"), &b))
+
+	bytes, err := json.Marshal(a + b)
+	require.NoError(t, err)
+	require.Equal(t, "0.3", string(bytes))
+}
@@ -0,0 +1,98 @@
+package memory
+
+import (
+	"context"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/model"
+	"time"
+)
+
+type idempotencyKey struct {
+	login string
+	key   string
+}
+
+type idempotencyRecord struct {
+	resp      model.IdempotentResponse
+	expiresAt time.Time
+}
+
+func (s *Storage) GetIdempotentResponse(_ context.Context, login, key string) (model.IdempotentResponse, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.idempotency[idempotencyKey{login: login, key: key}]
+	if !ok || !record.expiresAt.After(time.Now()) {
+		return model.IdempotentResponse{}, false, nil
+	}
+
+	resp := record.resp
+	resp.Body = append([]byte(nil), resp.Body...)
+	return resp, true, nil
+}
+
+// ReserveIdempotencyKey stores a pending record for the key unless a live one exists,
+// and returns the live record otherwise.
+func (s *Storage) ReserveIdempotencyKey(_ context.Context, login, key, requestHash string, ttl time.Duration) (model.IdempotentResponse, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	k := idempotencyKey{login: login, key: key}
+
+	if record, ok := s.idempotency[k]; ok && record.expiresAt.After(now) {
+		resp := record.resp
+		resp.Body = append([]byte(nil), resp.Body...)
+		return resp, false, nil
+	}
+
+	s.idempotency[k] = idempotencyRecord{resp: model.IdempotentResponse{RequestHash: requestHash}, expiresAt: now.Add(ttl)}
+	return model.IdempotentResponse{}, true, nil
+}
+
+// ReleaseIdempotencyKey drops a pending record, so the request may be retried.
+func (s *Storage) ReleaseIdempotencyKey(_ context.Context, login, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := idempotencyKey{login: login, key: key}
+	if record, ok := s.idempotency[k]; ok && record.resp.Pending() {
+		delete(s.idempotency, k)
+	}
+	return nil
+}
+
+// SaveIdempotentResponse stores the response unless a live record for the key already exists,
+// a pending record of the same request is completed.
+func (s *Storage) SaveIdempotentResponse(_ context.Context, login, key string, resp model.IdempotentResponse, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	k := idempotencyKey{login: login, key: key}
+
+	if record, ok := s.idempotency[k]; ok && record.expiresAt.After(now) &&
+		!(record.resp.Pending() && record.resp.RequestHash == resp.RequestHash) {
+		return nil
+	}
+
+	resp.Body = append([]byte(nil), resp.Body...)
+	s.idempotency[k] = idempotencyRecord{resp: resp, expiresAt: now.Add(ttl)}
+	return nil
+}
+
+func (s *Storage) DeleteExpiredIdempotencyKeys(_ context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var deleted int64
+
+	for k, record := range s.idempotency {
+		if !record.expiresAt.After(now) {
+			delete(s.idempotency, k)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
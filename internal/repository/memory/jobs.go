@@ -0,0 +1,74 @@
+package memory
+
+import (
+	"context"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/model"
+	"sort"
+	"time"
+)
+
+type accrualJob struct {
+	seq         uint64
+	attempts    int
+	nextPollAt  time.Time
+	leasedUntil time.Time
+}
+
+func (s *Storage) LeaseAccrualJobs(_ context.Context, now time.Time, limit int, lease time.Duration) ([]model.AccrualJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []string
+	for number, job := range s.jobs {
+		if !job.nextPollAt.After(now) && !job.leasedUntil.After(now) {
+			due = append(due, number)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		a, b := s.jobs[due[i]], s.jobs[due[j]]
+		if !a.nextPollAt.Equal(b.nextPollAt) {
+			return a.nextPollAt.Before(b.nextPollAt)
+		}
+		return a.seq < b.seq
+	})
+
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	jobs := make([]model.AccrualJob, 0, len(due))
+	for _, number := range due {
+		job := s.jobs[number]
+		job.attempts++
+		job.leasedUntil = now.Add(lease)
+		s.jobs[number] = job
+
+		o := s.orders[number]
+		jobs = append(jobs, model.AccrualJob{
+			Order: model.Order{
+				Number:     o.Number,
+				Status:     o.Status,
+				UploadedAt: o.UploadedAt,
+			},
+			Attempts: job.attempts,
+		})
+	}
+
+	return jobs, nil
+}
+
+func (s *Storage) RescheduleAccrualJob(_ context.Context, number string, nextPollAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[number]
+	if !ok {
+		return nil
+	}
+
+	job.nextPollAt = nextPollAt
+	job.leasedUntil = time.Time{}
+	s.jobs[number] = job
+	return nil
+}
@@ -0,0 +1,278 @@
+// Package memory is a repository kept in process memory with the same semantics as the Postgres one,
+// for tests and local development. Nothing survives a restart.
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/auth"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/model"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errorUnknownUser = errors.New("error: user doesn't exist")
+
+// seq breaks ties between rows created within the same clock tick, so listings stay in insertion order.
+type order struct {
+	login string
+	seq   uint64
+	model.Order
+}
+
+type withdrawal struct {
+	login string
+	seq   uint64
+	model.Withdraw
+}
+
+type Storage struct {
+	*auth.MemoryAttemptStore
+
+	mu          sync.Mutex
+	seq         uint64
+	users       map[string]model.User
+	orders      map[string]order
+	balances    map[string]model.Balance
+	withdrawals map[string]withdrawal
+	idempotency map[idempotencyKey]idempotencyRecord
+	refresh     map[string]refreshToken
+	revoked     map[string]time.Time
+	revokedAt   map[string]time.Time
+	jobs        map[string]accrualJob
+}
+
+func NewStorage() *Storage {
+	return &Storage{
+		MemoryAttemptStore: auth.NewMemoryAttemptStore(),
+
+		users:       make(map[string]model.User),
+		orders:      make(map[string]order),
+		balances:    make(map[string]model.Balance),
+		withdrawals: make(map[string]withdrawal),
+		idempotency: make(map[idempotencyKey]idempotencyRecord),
+		refresh:     make(map[string]refreshToken),
+		revoked:     make(map[string]time.Time),
+		revokedAt:   make(map[string]time.Time),
+		jobs:        make(map[string]accrualJob),
+	}
+}
+
+func (s *Storage) Create(_ context.Context, user model.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[user.Login]; ok {
+		return model.ErrorUserExists
+	}
+
+	s.users[user.Login] = user
+	s.balances[user.Login] = model.Balance{}
+	return nil
+}
+
+func (s *Storage) UpdateOrder(_ context.Context, login string, o model.Order) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.orders[o.Number]
+	if !ok {
+		if _, ok := s.users[login]; !ok {
+			return errorUnknownUser
+		}
+
+		now := time.Now()
+		s.seq++
+		s.orders[o.Number] = order{
+			login: login,
+			seq:   s.seq,
+			Order: model.Order{
+				Number:     o.Number,
+				Status:     model.OrderStatusNew,
+				UploadedAt: now,
+			},
+		}
+		s.jobs[o.Number] = accrualJob{seq: s.seq, nextPollAt: now}
+		return nil
+	}
+
+	if stored.login != login {
+		return model.ErrorOrderOfAnotherUser
+	}
+
+	if o.Status == "" {
+		return model.ErrorOrderUploaded
+	}
+
+	if !model.CanTransitOrder(stored.Status, o.Status) {
+		return fmt.Errorf("%w: order %s from %s to %s", model.ErrorOrderTransition, o.Number, stored.Status, o.Status)
+	}
+
+	var delta model.Money
+	if o.Accrual != nil {
+		delta += *o.Accrual
+	}
+	if stored.Accrual != nil {
+		delta -= *stored.Accrual
+	}
+
+	switch job, ok := s.jobs[o.Number]; {
+	case model.IsFinalOrderStatus(o.Status):
+		delete(s.jobs, o.Number)
+	case ok && o.Status != stored.Status:
+		// the poll backoff starts over in the new status
+		job.attempts = 0
+		s.jobs[o.Number] = job
+	}
+
+	stored.Status = o.Status
+	stored.Accrual = copyMoney(o.Accrual)
+	s.orders[o.Number] = stored
+
+	bal := s.balances[login]
+	bal.Current += delta
+	s.balances[login] = bal
+
+	return nil
+}
+
+func (s *Storage) GetBalance(_ context.Context, login string) (model.Balance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.balances[login], nil
+}
+
+func (s *Storage) GetOrderOwner(_ context.Context, orderNum string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.orders[orderNum]
+	if !ok {
+		return "", model.ErrorNotFound
+	}
+
+	return stored.login, nil
+}
+
+func (s *Storage) GetUser(_ context.Context, login string) (model.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[login]
+	if !ok {
+		return model.User{}, model.ErrorNotFound
+	}
+
+	return user, nil
+}
+
+func (s *Storage) UpdatePassword(_ context.Context, login, password string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[login]
+	if !ok {
+		return nil
+	}
+
+	user.Password = password
+	s.users[login] = user
+	return nil
+}
+
+func (s *Storage) GetOrders(_ context.Context, login string) ([]model.Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stored []order
+	for _, o := range s.orders {
+		if o.login == login {
+			stored = append(stored, o)
+		}
+	}
+
+	return sortOrders(stored), nil
+}
+
+func (s *Storage) Withdraw(_ context.Context, login string, w model.Withdraw) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.withdrawals[w.Order]; ok {
+		return model.ErrorWithdrawExists
+	}
+
+	bal := s.balances[login]
+	if bal.Current < w.Sum {
+		return model.ErrorInsufficientFunds
+	}
+
+	now := time.Now()
+	s.seq++
+	s.withdrawals[w.Order] = withdrawal{
+		login: login,
+		seq:   s.seq,
+		Withdraw: model.Withdraw{
+			Order:       w.Order,
+			Sum:         w.Sum,
+			ProcessedAt: &now,
+		},
+	}
+
+	bal.Current -= w.Sum
+	bal.Withdrawn += w.Sum
+	s.balances[login] = bal
+
+	return nil
+}
+
+func (s *Storage) GetWithdrawals(_ context.Context, login string) ([]model.Withdraw, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stored []withdrawal
+	for _, w := range s.withdrawals {
+		if w.login == login {
+			stored = append(stored, w)
+		}
+	}
+
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].seq < stored[j].seq
+	})
+
+	withdrawals := make([]model.Withdraw, 0, len(stored))
+	for _, w := range stored {
+		processedAt := *w.ProcessedAt
+		withdrawals = append(withdrawals, model.Withdraw{Order: w.Order, Sum: w.Sum, ProcessedAt: &processedAt})
+	}
+
+	return withdrawals, nil
+}
+
+// sortOrders returns copies of the orders by upload time, just like ORDER BY uploaded_at.
+func sortOrders(stored []order) []model.Order {
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].seq < stored[j].seq
+	})
+
+	orders := make([]model.Order, 0, len(stored))
+	for _, o := range stored {
+		o.Accrual = copyMoney(o.Accrual)
+		orders = append(orders, o.Order)
+	}
+
+	return orders
+}
+
+func copyMoney(m *model.Money) *model.Money {
+	if m == nil {
+		return nil
+	}
+
+	v := *m
+	return &v
+}
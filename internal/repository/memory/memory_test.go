@@ -0,0 +1,12 @@
+package memory
+
+import (
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/repository/repotest"
+	"testing"
+)
+
+func TestStorage_Contract(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) repotest.Repository {
+		return NewStorage()
+	})
+}
@@ -0,0 +1,137 @@
+package memory
+
+import (
+	"context"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/model"
+	"time"
+)
+
+type refreshToken struct {
+	login     string
+	expiresAt time.Time
+	revokedAt *time.Time
+}
+
+func (s *Storage) SaveRefreshToken(_ context.Context, login, hash string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.refresh[hash]; ok {
+		return model.ErrorConflict
+	}
+
+	s.refresh[hash] = refreshToken{login: login, expiresAt: expiresAt}
+	return nil
+}
+
+// RotateRefreshToken revokes the presented refresh token and stores its replacement.
+// Presenting an already revoked token is treated as theft and revokes every session of the user.
+func (s *Storage) RotateRefreshToken(_ context.Context, oldHash, newHash string, expiresAt time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	token, ok := s.refresh[oldHash]
+	if !ok {
+		return "", model.ErrorRefreshTokenInvalid
+	}
+
+	if token.revokedAt != nil {
+		s.revokeAllTokens(token.login, now)
+		return "", model.ErrorRefreshTokenInvalid
+	}
+
+	if !token.expiresAt.After(now) {
+		return "", model.ErrorRefreshTokenInvalid
+	}
+
+	token.revokedAt = &now
+	s.refresh[oldHash] = token
+	s.refresh[newHash] = refreshToken{login: token.login, expiresAt: expiresAt}
+
+	return token.login, nil
+}
+
+func (s *Storage) RevokeRefreshToken(_ context.Context, login, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.refresh[hash]
+	if !ok || token.login != login || token.revokedAt != nil {
+		return nil
+	}
+
+	now := time.Now()
+	token.revokedAt = &now
+	s.refresh[hash] = token
+	return nil
+}
+
+func (s *Storage) RevokeAccessToken(_ context.Context, jti string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.revoked[jti]; !ok {
+		s.revoked[jti] = expiresAt
+	}
+	return nil
+}
+
+func (s *Storage) RevokeAllTokens(_ context.Context, login string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.revokeAllTokens(login, time.Now())
+	return nil
+}
+
+func (s *Storage) revokeAllTokens(login string, now time.Time) {
+	// kept to the second like the iat claim, see the postgres storage
+	if _, ok := s.users[login]; ok {
+		s.revokedAt[login] = now.Truncate(time.Second)
+	}
+
+	for hash, token := range s.refresh {
+		if token.login == login && token.revokedAt == nil {
+			token.revokedAt = &now
+			s.refresh[hash] = token
+		}
+	}
+}
+
+func (s *Storage) IsAccessTokenRevoked(_ context.Context, jti, login string, issuedAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.revoked[jti]; ok {
+		return true, nil
+	}
+
+	revokedAt, ok := s.revokedAt[login]
+	return ok && revokedAt.After(issuedAt), nil
+}
+
+func (s *Storage) DeleteExpiredTokens(_ context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var deleted int64
+
+	for jti, expiresAt := range s.revoked {
+		if !expiresAt.After(now) {
+			delete(s.revoked, jti)
+			deleted++
+		}
+	}
+
+	for hash, token := range s.refresh {
+		if !token.expiresAt.After(now) {
+			delete(s.refresh, hash)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
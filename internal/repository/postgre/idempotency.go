@@ -0,0 +1,110 @@
+package postgre
+
+import (
+	"context"
+	"errors"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/model"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+func (s *Storage) GetIdempotentResponse(ctx context.Context, login, key string) (resp model.IdempotentResponse, found bool, err error) {
+	query := `SELECT request_hash, status_code, content_type, body FROM idempotency_keys
+WHERE login = $1 AND key = $2 AND expires_at > $3`
+
+	row := s.pool.QueryRow(ctx, query, login, key, time.Now())
+
+	err = row.Scan(&resp.RequestHash, &resp.StatusCode, &resp.ContentType, &resp.Body)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return model.IdempotentResponse{}, false, nil
+	}
+	if err != nil {
+		return model.IdempotentResponse{}, false, wrapError(err)
+	}
+
+	return resp, true, nil
+}
+
+// ReserveIdempotencyKey stores a pending record for the key unless a live one exists,
+// and returns the live record otherwise.
+func (s *Storage) ReserveIdempotencyKey(ctx context.Context, login, key, requestHash string, ttl time.Duration) (model.IdempotentResponse, bool, error) {
+	query := `INSERT INTO idempotency_keys VALUES ($1, $2, $3, 0, '', NULL, $4, $5)
+ON CONFLICT (login, key) DO UPDATE SET
+	request_hash = EXCLUDED.request_hash,
+	status_code = EXCLUDED.status_code,
+	content_type = EXCLUDED.content_type,
+	body = EXCLUDED.body,
+	created_at = EXCLUDED.created_at,
+	expires_at = EXCLUDED.expires_at
+WHERE idempotency_keys.expires_at <= EXCLUDED.created_at`
+
+	// the live record may expire or be released between the insert and the read, then it's tried again
+	for i := 0; i < 3; i++ {
+		now := time.Now()
+		tag, err := s.pool.Exec(ctx, query, login, key, requestHash, now, now.Add(ttl))
+		if err != nil {
+			return model.IdempotentResponse{}, false, wrapError(err)
+		}
+
+		if tag.RowsAffected() > 0 {
+			return model.IdempotentResponse{}, true, nil
+		}
+
+		resp, found, err := s.GetIdempotentResponse(ctx, login, key)
+		if err != nil || found {
+			return resp, false, err
+		}
+	}
+
+	return model.IdempotentResponse{}, false, errors.New("error: idempotency key keeps changing")
+}
+
+// ReleaseIdempotencyKey drops a pending record, so the request may be retried.
+func (s *Storage) ReleaseIdempotencyKey(ctx context.Context, login, key string) error {
+	query := `DELETE FROM idempotency_keys WHERE login = $1 AND key = $2 AND status_code = 0`
+
+	_, err := s.pool.Exec(ctx, query, login, key)
+	return wrapError(err)
+}
+
+// SaveIdempotentResponse stores the response unless a live record for the key already exists,
+// a pending record of the same request is completed.
+func (s *Storage) SaveIdempotentResponse(ctx context.Context, login, key string, resp model.IdempotentResponse, ttl time.Duration) error {
+	query := `INSERT INTO idempotency_keys VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+ON CONFLICT (login, key) DO UPDATE SET
+	request_hash = EXCLUDED.request_hash,
+	status_code = EXCLUDED.status_code,
+	content_type = EXCLUDED.content_type,
+	body = EXCLUDED.body,
+	created_at = EXCLUDED.created_at,
+	expires_at = EXCLUDED.expires_at
+WHERE idempotency_keys.expires_at <= EXCLUDED.created_at
+	OR idempotency_keys.status_code = 0 AND idempotency_keys.request_hash = EXCLUDED.request_hash`
+
+	now := time.Now()
+	_, err := s.pool.Exec(
+		ctx,
+		query,
+		login,
+		key,
+		resp.RequestHash,
+		resp.StatusCode,
+		resp.ContentType,
+		resp.Body,
+		now,
+		now.Add(ttl),
+	)
+
+	return wrapError(err)
+}
+
+func (s *Storage) DeleteExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	query := `DELETE FROM idempotency_keys WHERE expires_at <= $1`
+
+	tag, err := s.pool.Exec(ctx, query, time.Now())
+	if err != nil {
+		return 0, wrapError(err)
+	}
+
+	return tag.RowsAffected(), nil
+}
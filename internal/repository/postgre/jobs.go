@@ -0,0 +1,91 @@
+package postgre
+
+import (
+	"context"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/model"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+// createOrder stores a new order together with its accrual job, so the order is polled
+// even if this instance dies right after the upload. When a concurrent upload of the same
+// number wins, the owner decides between ErrorOrderUploaded and ErrorOrderOfAnotherUser.
+func (s *Storage) createOrder(ctx context.Context, login, number string) error {
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		orderQuery := `INSERT INTO orders (number, login, status, uploaded_at) VALUES ($1, $2, $3, $4)
+ON CONFLICT (number) DO NOTHING`
+		ownerQuery := `SELECT login FROM orders WHERE number = $1`
+		jobQuery := `INSERT INTO accrual_jobs (number, next_poll_at) VALUES ($1, $2)`
+
+		now := time.Now()
+		tag, err := tx.Exec(ctx, orderQuery, number, login, model.OrderStatusNew, now)
+		if err != nil {
+			return err
+		}
+
+		if tag.RowsAffected() == 0 {
+			var owner string
+			err = tx.QueryRow(ctx, ownerQuery, number).Scan(&owner)
+			if err != nil {
+				return err
+			}
+
+			if owner != login {
+				return model.ErrorOrderOfAnotherUser
+			}
+			return model.ErrorOrderUploaded
+		}
+
+		_, err = tx.Exec(ctx, jobQuery, number, now)
+		return err
+	})
+	return wrapError(err)
+}
+
+// LeaseAccrualJobs hands out up to limit due jobs until now+lease. Rows leased by other
+// instances are skipped instead of waited for, so each job is polled by a single worker.
+func (s *Storage) LeaseAccrualJobs(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]model.AccrualJob, error) {
+	query := `WITH due AS (
+	SELECT number FROM accrual_jobs
+	WHERE next_poll_at <= $1 AND (leased_until IS NULL OR leased_until <= $1)
+	ORDER BY next_poll_at
+	LIMIT $2
+	FOR UPDATE SKIP LOCKED
+)
+UPDATE accrual_jobs j SET attempts = j.attempts + 1, leased_until = $3
+FROM due, orders o
+WHERE j.number = due.number AND o.number = j.number
+RETURNING j.number, o.status, o.uploaded_at, j.attempts`
+
+	rows, err := s.pool.Query(ctx, query, now, limit, now.Add(lease))
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	defer rows.Close()
+
+	jobs := make([]model.AccrualJob, 0, limit)
+	for rows.Next() {
+		var job model.AccrualJob
+
+		err := rows.Scan(&job.Order.Number, &job.Order.Status, &job.Order.UploadedAt, &job.Attempts)
+		if err != nil {
+			return nil, wrapError(err)
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, wrapError(err)
+	}
+
+	return jobs, nil
+}
+
+// RescheduleAccrualJob releases the lease of a job and sets its next poll, jobs of orders
+// in a final status are already gone and are left alone.
+func (s *Storage) RescheduleAccrualJob(ctx context.Context, number string, nextPollAt time.Time) error {
+	query := `UPDATE accrual_jobs SET next_poll_at = $1, leased_until = NULL WHERE number = $2`
+	_, err := s.pool.Exec(ctx, query, nextPollAt, number)
+	return wrapError(err)
+}
@@ -0,0 +1,102 @@
+package postgre
+
+import (
+	"context"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/auth"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/model"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+// ReserveLoginAttempt counts an attempt unless the key is locked, a counter idle for longer than window
+// starts over. The key is locked for lockout(failures) when that's positive. The row stays locked
+// from the read to the update, so concurrent attempts are counted one by one.
+func (s *Storage) ReserveLoginAttempt(ctx context.Context, key string, now time.Time, window time.Duration, lockout func(failures int) time.Duration) (model.LoginAttempts, bool, error) {
+	var attempts model.LoginAttempts
+	var reserved bool
+
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		insertQuery := `INSERT INTO login_attempts (key, failures, last_failure_at) VALUES ($1, 0, $2) ON CONFLICT (key) DO NOTHING`
+		selectQuery := `SELECT failures, last_failure_at, locked_until FROM login_attempts WHERE key = $1 FOR UPDATE`
+		updateQuery := `UPDATE login_attempts SET failures = $1, last_failure_at = $2, locked_until = $3 WHERE key = $4`
+
+		_, err := tx.Exec(ctx, insertQuery, key, now)
+		if err != nil {
+			return err
+		}
+
+		var lockedUntil *time.Time
+		err = tx.QueryRow(ctx, selectQuery, key).Scan(&attempts.Failures, &attempts.LastFailureAt, &lockedUntil)
+		if err != nil {
+			return err
+		}
+
+		if lockedUntil != nil {
+			attempts.LockedUntil = *lockedUntil
+		}
+
+		if attempts.LockedUntil.After(now) {
+			return nil
+		}
+
+		if !attempts.LastFailureAt.After(now.Add(-window)) {
+			attempts.Failures = 0
+		}
+
+		attempts.Failures++
+		attempts.LastFailureAt = now
+		if d := lockout(attempts.Failures); d > 0 {
+			attempts.LockedUntil = now.Add(d)
+			lockedUntil = &attempts.LockedUntil
+		}
+
+		reserved = true
+		_, err = tx.Exec(ctx, updateQuery, attempts.Failures, attempts.LastFailureAt, lockedUntil, key)
+		return err
+	})
+	if err != nil {
+		return model.LoginAttempts{}, false, wrapError(err)
+	}
+
+	return attempts, reserved, nil
+}
+
+func (s *Storage) RefundLoginAttempt(ctx context.Context, key string) error {
+	query := `UPDATE login_attempts SET failures = failures - 1 WHERE key = $1 AND failures > 0`
+	_, err := s.pool.Exec(ctx, query, key)
+	return wrapError(err)
+}
+
+func (s *Storage) ResetLoginAttempts(ctx context.Context, key string) error {
+	query := `DELETE FROM login_attempts WHERE key = $1`
+	_, err := s.pool.Exec(ctx, query, key)
+	return wrapError(err)
+}
+
+func (s *Storage) SaveLockoutEvent(ctx context.Context, event model.LockoutEvent) error {
+	query := `INSERT INTO lockout_events (key, login, ip, failures, locked_until, created_at) VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err := s.pool.Exec(
+		ctx,
+		query,
+		event.Key,
+		event.Login,
+		event.IP,
+		event.Failures,
+		event.LockedUntil,
+		event.CreatedAt,
+	)
+	return wrapError(err)
+}
+
+// DeleteExpiredLoginAttempts drops counters that are neither recent nor locked, lockout events are kept for audit.
+func (s *Storage) DeleteExpiredLoginAttempts(ctx context.Context) (int64, error) {
+	query := `DELETE FROM login_attempts WHERE last_failure_at <= $1 AND (locked_until IS NULL OR locked_until <= $2)`
+
+	now := time.Now()
+	tag, err := s.pool.Exec(ctx, query, now.Add(-auth.LoginAttemptsRetention), now)
+	if err != nil {
+		return 0, wrapError(err)
+	}
+
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,123 @@
+package postgre
+
+import (
+	"context"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/testdb"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestLoadMigrations_Embedded(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+
+	for i, m := range migrations {
+		require.Equal(t, i+1, m.Version, "migration versions must be sequential")
+		require.NotEmpty(t, m.Up)
+		require.NotEmpty(t, m.Down)
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   fstest.MapFS
+		want    []int
+		wantErr bool
+	}{
+		{
+			name: "sorted_by_version",
+			files: fstest.MapFS{
+				"m/0002_b.up.sql":   {Data: []byte("B")},
+				"m/0002_b.down.sql": {Data: []byte("-B")},
+				"m/0001_a.up.sql":   {Data: []byte("A")},
+				"m/0001_a.down.sql": {Data: []byte("-A")},
+			},
+			want: []int{1, 2},
+		},
+		{
+			name: "missing_down",
+			files: fstest.MapFS{
+				"m/0001_a.up.sql": {Data: []byte("A")},
+			},
+			wantErr: true,
+		},
+		{
+			name: "conflicting_names",
+			files: fstest.MapFS{
+				"m/0001_a.up.sql":   {Data: []byte("A")},
+				"m/0001_b.down.sql": {Data: []byte("-B")},
+			},
+			wantErr: true,
+		},
+		{
+			name: "unexpected_file",
+			files: fstest.MapFS{
+				"m/readme.md": {Data: []byte("")},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrations, err := loadMigrations(tt.files, "m")
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			versions := make([]int, 0, len(migrations))
+			for _, m := range migrations {
+				versions = append(versions, m.Version)
+			}
+			require.Equal(t, tt.want, versions)
+		})
+	}
+}
+
+func TestMigrate_DuplicateWithdrawals(t *testing.T) {
+	ctx := context.Background()
+	pool := testdb.Pool(t)
+
+	migrator, err := NewMigrator(pool)
+	require.NoError(t, err)
+	all := migrator.migrations
+
+	// the ledger before the primary key, already charged for both copies of order 1
+	migrator.migrations = all[:2]
+	_, err = migrator.Up(ctx)
+	require.NoError(t, err)
+
+	now := time.Now()
+	_, err = pool.Exec(ctx, `INSERT INTO users (login, password, created_at) VALUES ('gopher', 'hash', $1)`, now)
+	require.NoError(t, err)
+	_, err = pool.Exec(ctx, `INSERT INTO orders (number, login, status, accrual, uploaded_at) VALUES ('79927398713', 'gopher', 'PROCESSED', 100, $1)`, now)
+	require.NoError(t, err)
+	_, err = pool.Exec(ctx, `INSERT INTO withdrawals (number, login, sum, processed_at) VALUES
+		('2377225624', 'gopher', 30, $1), ('2377225624', 'gopher', 30, $2), ('12345678903', 'gopher', 10, $1)`, now, now.Add(time.Second))
+	require.NoError(t, err)
+	_, err = pool.Exec(ctx, `UPDATE balances SET current = 30, withdrawn = 70 WHERE login = 'gopher'`)
+	require.NoError(t, err)
+
+	migrator.migrations = all[:3]
+	applied, err := migrator.Up(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, applied)
+
+	var withdrawals int
+	require.NoError(t, pool.QueryRow(ctx, `SELECT COUNT(*) FROM withdrawals`).Scan(&withdrawals))
+	require.Equal(t, 2, withdrawals)
+
+	var current, withdrawn float64
+	require.NoError(t, pool.QueryRow(ctx, `SELECT current, withdrawn FROM balances WHERE login = 'gopher'`).Scan(&current, &withdrawn))
+	require.Equal(t, 60.0, current)
+	require.Equal(t, 40.0, withdrawn)
+
+	migrator.migrations = all
+	_, err = migrator.Up(ctx)
+	require.NoError(t, err)
+}
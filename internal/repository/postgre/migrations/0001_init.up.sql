@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS users (
+    login VARCHAR(100) PRIMARY KEY,
+    password VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS orders (
+    number VARCHAR(100) PRIMARY KEY,
+    login VARCHAR(100) NOT NULL,
+    status VARCHAR(15) NOT NULL,
+    accrual DOUBLE PRECISION,
+    uploaded_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (login) REFERENCES users (login)
+);
+
+CREATE TABLE IF NOT EXISTS withdrawals (
+    number VARCHAR(100) NOT NULL,
+    login VARCHAR(100) NOT NULL,
+    sum DOUBLE PRECISION,
+    processed_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (login) REFERENCES users (login)
+);
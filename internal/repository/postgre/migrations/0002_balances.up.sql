@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS balances (
+    login VARCHAR(100) PRIMARY KEY,
+    current DOUBLE PRECISION NOT NULL DEFAULT 0,
+    withdrawn DOUBLE PRECISION NOT NULL DEFAULT 0,
+    FOREIGN KEY (login) REFERENCES users (login)
+);
+
+INSERT INTO balances (login, current, withdrawn)
+SELECT u.login,
+    COALESCE(o.accrued, 0) - COALESCE(w.withdrawn, 0),
+    COALESCE(w.withdrawn, 0)
+FROM users u
+LEFT JOIN (SELECT login, SUM(accrual) AS accrued FROM orders GROUP BY login) o ON o.login = u.login
+LEFT JOIN (SELECT login, SUM(sum) AS withdrawn FROM withdrawals GROUP BY login) w ON w.login = u.login
+ON CONFLICT (login) DO NOTHING;
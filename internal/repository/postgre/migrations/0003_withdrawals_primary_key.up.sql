@@ -0,0 +1,34 @@
+-- withdrawals of the same order made before the key existed are kept once, the earliest one,
+-- and the sums of the extra ones are credited back
+DO $$
+DECLARE
+    duplicates TEXT;
+BEGIN
+    SELECT string_agg(number, ', ' ORDER BY number) INTO duplicates
+    FROM (SELECT number FROM withdrawals GROUP BY number HAVING COUNT(*) > 1) d;
+
+    IF duplicates IS NOT NULL THEN
+        RAISE NOTICE 'removing duplicate withdrawals of orders %', duplicates;
+    END IF;
+END $$;
+
+WITH ranked AS (
+    SELECT ctid, ROW_NUMBER() OVER (PARTITION BY number ORDER BY processed_at, ctid) AS n
+    FROM withdrawals
+), removed AS (
+    DELETE FROM withdrawals w
+    USING ranked r
+    WHERE w.ctid = r.ctid AND r.n > 1
+    RETURNING w.login, COALESCE(w.sum, 0) AS sum
+)
+UPDATE balances b
+SET current = b.current + d.sum, withdrawn = b.withdrawn - d.sum
+FROM (SELECT login, SUM(sum) AS sum FROM removed GROUP BY login) d
+WHERE b.login = d.login;
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conrelid = 'withdrawals'::regclass AND contype = 'p') THEN
+        ALTER TABLE withdrawals ADD PRIMARY KEY (number);
+    END IF;
+END $$;
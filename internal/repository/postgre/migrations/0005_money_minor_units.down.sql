@@ -0,0 +1,7 @@
+ALTER TABLE orders ALTER COLUMN accrual TYPE DOUBLE PRECISION USING accrual / 100.0;
+
+ALTER TABLE withdrawals ALTER COLUMN sum TYPE DOUBLE PRECISION USING sum / 100.0;
+
+ALTER TABLE balances
+    ALTER COLUMN current TYPE DOUBLE PRECISION USING current / 100.0,
+    ALTER COLUMN withdrawn TYPE DOUBLE PRECISION USING withdrawn / 100.0;
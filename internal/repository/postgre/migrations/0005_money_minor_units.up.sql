@@ -0,0 +1,20 @@
+ALTER TABLE orders ALTER COLUMN accrual TYPE BIGINT USING ROUND(accrual * 100)::BIGINT;
+
+ALTER TABLE withdrawals ALTER COLUMN sum TYPE BIGINT USING ROUND(sum * 100)::BIGINT;
+
+ALTER TABLE balances
+    ALTER COLUMN current TYPE BIGINT USING ROUND(current * 100)::BIGINT,
+    ALTER COLUMN withdrawn TYPE BIGINT USING ROUND(withdrawn * 100)::BIGINT;
+
+-- rebuild the ledger from the rounded history so it can't drift from it
+UPDATE balances b
+SET current = h.current, withdrawn = h.withdrawn
+FROM (
+    SELECT u.login,
+        COALESCE(o.accrued, 0) - COALESCE(w.withdrawn, 0) AS current,
+        COALESCE(w.withdrawn, 0) AS withdrawn
+    FROM users u
+    LEFT JOIN (SELECT login, SUM(accrual) AS accrued FROM orders GROUP BY login) o ON o.login = u.login
+    LEFT JOIN (SELECT login, SUM(sum) AS withdrawn FROM withdrawals GROUP BY login) w ON w.login = u.login
+) h
+WHERE b.login = h.login;
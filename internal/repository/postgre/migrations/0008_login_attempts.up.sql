@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS login_attempts (
+    key VARCHAR(300) PRIMARY KEY,
+    failures INTEGER NOT NULL,
+    last_failure_at TIMESTAMP NOT NULL,
+    locked_until TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS login_attempts_last_failure_at_idx ON login_attempts (last_failure_at);
+
+CREATE TABLE IF NOT EXISTS lockout_events (
+    id BIGSERIAL PRIMARY KEY,
+    key VARCHAR(300) NOT NULL,
+    login VARCHAR(255) NOT NULL,
+    ip VARCHAR(64) NOT NULL,
+    failures INTEGER NOT NULL,
+    locked_until TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS lockout_events_created_at_idx ON lockout_events (created_at);
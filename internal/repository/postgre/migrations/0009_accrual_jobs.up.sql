@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS accrual_jobs (
+    number VARCHAR(100) PRIMARY KEY,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_poll_at TIMESTAMP NOT NULL,
+    leased_until TIMESTAMP,
+    FOREIGN KEY (number) REFERENCES orders (number) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS accrual_jobs_next_poll_at_idx ON accrual_jobs (next_poll_at);
+
+INSERT INTO accrual_jobs (number, next_poll_at)
+SELECT number, uploaded_at FROM orders WHERE status IN ('NEW', 'PROCESSING')
+ON CONFLICT (number) DO NOTHING;
@@ -0,0 +1,30 @@
+ALTER TABLE users
+    ALTER COLUMN created_at TYPE TIMESTAMP,
+    ALTER COLUMN tokens_revoked_at TYPE TIMESTAMP;
+
+ALTER TABLE orders ALTER COLUMN uploaded_at TYPE TIMESTAMP;
+
+ALTER TABLE withdrawals ALTER COLUMN processed_at TYPE TIMESTAMP;
+
+ALTER TABLE idempotency_keys
+    ALTER COLUMN created_at TYPE TIMESTAMP,
+    ALTER COLUMN expires_at TYPE TIMESTAMP;
+
+ALTER TABLE refresh_tokens
+    ALTER COLUMN created_at TYPE TIMESTAMP,
+    ALTER COLUMN expires_at TYPE TIMESTAMP,
+    ALTER COLUMN revoked_at TYPE TIMESTAMP;
+
+ALTER TABLE revoked_tokens ALTER COLUMN expires_at TYPE TIMESTAMP;
+
+ALTER TABLE login_attempts
+    ALTER COLUMN last_failure_at TYPE TIMESTAMP,
+    ALTER COLUMN locked_until TYPE TIMESTAMP;
+
+ALTER TABLE lockout_events
+    ALTER COLUMN locked_until TYPE TIMESTAMP,
+    ALTER COLUMN created_at TYPE TIMESTAMP;
+
+ALTER TABLE accrual_jobs
+    ALTER COLUMN next_poll_at TYPE TIMESTAMP,
+    ALTER COLUMN leased_until TYPE TIMESTAMP;
@@ -0,0 +1,32 @@
+-- times were stored as the local wall clock of the process and read back as UTC, which was off by
+-- the offset outside UTC; existing values are taken as wall clock of the session time zone
+ALTER TABLE users
+    ALTER COLUMN created_at TYPE TIMESTAMPTZ,
+    ALTER COLUMN tokens_revoked_at TYPE TIMESTAMPTZ;
+
+ALTER TABLE orders ALTER COLUMN uploaded_at TYPE TIMESTAMPTZ;
+
+ALTER TABLE withdrawals ALTER COLUMN processed_at TYPE TIMESTAMPTZ;
+
+ALTER TABLE idempotency_keys
+    ALTER COLUMN created_at TYPE TIMESTAMPTZ,
+    ALTER COLUMN expires_at TYPE TIMESTAMPTZ;
+
+ALTER TABLE refresh_tokens
+    ALTER COLUMN created_at TYPE TIMESTAMPTZ,
+    ALTER COLUMN expires_at TYPE TIMESTAMPTZ,
+    ALTER COLUMN revoked_at TYPE TIMESTAMPTZ;
+
+ALTER TABLE revoked_tokens ALTER COLUMN expires_at TYPE TIMESTAMPTZ;
+
+ALTER TABLE login_attempts
+    ALTER COLUMN last_failure_at TYPE TIMESTAMPTZ,
+    ALTER COLUMN locked_until TYPE TIMESTAMPTZ;
+
+ALTER TABLE lockout_events
+    ALTER COLUMN locked_until TYPE TIMESTAMPTZ,
+    ALTER COLUMN created_at TYPE TIMESTAMPTZ;
+
+ALTER TABLE accrual_jobs
+    ALTER COLUMN next_poll_at TYPE TIMESTAMPTZ,
+    ALTER COLUMN leased_until TYPE TIMESTAMPTZ;
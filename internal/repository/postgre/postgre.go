@@ -3,159 +3,198 @@ package postgre
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/model"
 	"github.com/jackc/pgx/v5"
-	"log"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"net"
 	"time"
 )
 
 const (
-	userTable = `CREATE TABLE IF NOT EXISTS users (
-    login VARCHAR(100) PRIMARY KEY,
-    password VARCHAR(100) NOT NULL,
-    created_at TIMESTAMP NOT NULL
-);`
-
-	orderTable = `CREATE TABLE IF NOT EXISTS orders (
-    number VARCHAR(100) PRIMARY KEY,
-	login VARCHAR(100) NOT NULL,
-	status VARCHAR(15) NOT NULL,
-	accrual DOUBLE PRECISION,
-    uploaded_at TIMESTAMP NOT NULL,
-	FOREIGN KEY (login) REFERENCES users (login)
-);`
-
-	withdrawTable = `CREATE TABLE IF NOT EXISTS withdrawals (
-    number VARCHAR(100) NOT NULL,
-	login VARCHAR(100) NOT NULL,
-	sum DOUBLE PRECISION,
-    processed_at TIMESTAMP NOT NULL,
-	FOREIGN KEY (login) REFERENCES users (login)
-);`
-)
-
-var (
-	ErrorConflict = errors.New("error: login don't match")
-	ErrorOk       = errors.New("error: already was uploaded")
+	// historyBalanceQuery recomputes every user's balance from orders and withdrawals.
+	historyBalanceQuery = `SELECT u.login,
+	COALESCE(o.accrued, 0) - COALESCE(w.withdrawn, 0),
+	COALESCE(w.withdrawn, 0)
+FROM users u
+LEFT JOIN (SELECT login, SUM(accrual)::BIGINT AS accrued FROM orders GROUP BY login) o ON o.login = u.login
+LEFT JOIN (SELECT login, SUM(sum)::BIGINT AS withdrawn FROM withdrawals GROUP BY login) w ON w.login = u.login`
 )
 
 type Storage struct {
-	conn *pgx.Conn
+	pool *pgxpool.Pool
 }
 
-func NewStorage(conn *pgx.Conn) (*Storage, error) {
-	s := &Storage{
-		conn: conn,
+func NewStorage(pool *pgxpool.Pool) *Storage {
+	return &Storage{
+		pool: pool,
 	}
+}
 
-	err := s.ensureTablesExist()
-	if err != nil {
-		return &Storage{}, err
-	}
+// Create relies on the primary key of users, so concurrent registrations of one login can't both succeed.
+func (s *Storage) Create(ctx context.Context, user model.User) error {
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		userQuery := `INSERT INTO users VALUES ($1, $2, $3)`
+		_, err := tx.Exec(ctx, userQuery, user.Login, user.Password, time.Now())
+		if isUniqueViolation(err) {
+			return model.ErrorUserExists
+		}
+		if err != nil {
+			return err
+		}
 
-	return s, nil
+		balanceQuery := `INSERT INTO balances (login) VALUES ($1)`
+		_, err = tx.Exec(ctx, balanceQuery, user.Login)
+		return err
+	})
+	return wrapError(err)
 }
 
-func (s *Storage) ensureTablesExist() error {
-	_, err := s.conn.Exec(context.Background(), userTable)
+func (s *Storage) UpdateOrder(ctx context.Context, login string, order model.Order) error {
+	loginDB, err := s.GetOrderOwner(ctx, order.Number)
+	if errors.Is(err, model.ErrorNotFound) {
+		return s.createOrder(ctx, login, order.Number)
+	}
 	if err != nil {
 		return err
 	}
 
-	_, err = s.conn.Exec(context.Background(), orderTable)
-	if err != nil {
-		return err
+	if login != loginDB {
+		return model.ErrorOrderOfAnotherUser
 	}
 
-	_, err = s.conn.Exec(context.Background(), withdrawTable)
-	return err
-}
+	if order.Status == "" {
+		return model.ErrorOrderUploaded
+	}
 
-func (s *Storage) Create(user model.User) error {
-	query := `INSERT INTO users VALUES ($1, $2, $3)`
-	_, err := s.conn.Exec(context.Background(), query, user.Login, user.Password, time.Now())
-	return err
-}
+	err = pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		selectQuery := `SELECT status, accrual FROM orders WHERE number = $1 FOR UPDATE`
+		updateQuery := `UPDATE orders SET status = $1, accrual = $2 WHERE number = $3`
 
-func (s *Storage) UpdateOrder(login string, order model.Order) error {
-	loginDB, err := s.GetOrderOwner(order.Number)
-	if err != nil {
-		log.Println(err)
-		creationQuery := `INSERT INTO orders (number, login, status, uploaded_at) VALUES($1, $2, $3, $4)`
+		var prevStatus string
+		var prevAccrual *model.Money
+		err := tx.QueryRow(ctx, selectQuery, order.Number).Scan(&prevStatus, &prevAccrual)
+		if err != nil {
+			return err
+		}
 
-		_, err := s.conn.Exec(
-			context.Background(),
-			creationQuery,
+		if !model.CanTransitOrder(prevStatus, order.Status) {
+			return fmt.Errorf("%w: order %s from %s to %s", model.ErrorOrderTransition, order.Number, prevStatus, order.Status)
+		}
+
+		_, err = tx.Exec(
+			ctx,
+			updateQuery,
+			order.Status,
+			order.Accrual,
 			order.Number,
-			login,
-			"NEW",
-			time.Now(),
 		)
-		return err
-	}
+		if err != nil {
+			return err
+		}
 
-	if login != loginDB {
-		return ErrorConflict
-	}
+		switch {
+		case model.IsFinalOrderStatus(order.Status):
+			_, err = tx.Exec(ctx, `DELETE FROM accrual_jobs WHERE number = $1`, order.Number)
+		case order.Status != prevStatus:
+			// the poll backoff starts over in the new status
+			_, err = tx.Exec(ctx, `UPDATE accrual_jobs SET attempts = 0 WHERE number = $1`, order.Number)
+		}
+		if err != nil {
+			return err
+		}
 
-	if order.Status == "" {
-		return ErrorOk
-	}
+		var delta model.Money
+		if order.Accrual != nil {
+			delta += *order.Accrual
+		}
+		if prevAccrual != nil {
+			delta -= *prevAccrual
+		}
+
+		if delta == 0 {
+			return nil
+		}
 
-	updateQuery := `UPDATE orders SET status = $1, accrual = $2 WHERE number = $3`
+		return addBalance(ctx, tx, login, delta, 0)
+	})
+	return wrapError(err)
+}
+
+// addBalance applies a change to the user's balance row inside the caller's transaction.
+func addBalance(ctx context.Context, tx pgx.Tx, login string, current, withdrawn model.Money) error {
+	query := `INSERT INTO balances (login, current, withdrawn) VALUES ($1, $2, $3)
+ON CONFLICT (login) DO UPDATE SET current = balances.current + EXCLUDED.current, withdrawn = balances.withdrawn + EXCLUDED.withdrawn`
 
-	_, err = s.conn.Exec(
-		context.Background(),
-		updateQuery,
-		order.Status,
-		order.Accrual,
-		order.Number,
-	)
+	_, err := tx.Exec(ctx, query, login, current, withdrawn)
 	return err
 }
 
-func (s *Storage) GetOrderOwner(orderNum string) (login string, err error) {
+func (s *Storage) GetBalance(ctx context.Context, login string) (model.Balance, error) {
+	query := `SELECT current, withdrawn FROM balances WHERE login = $1`
+
+	var bal model.Balance
+	err := s.pool.QueryRow(ctx, query, login).Scan(&bal.Current, &bal.Withdrawn)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return model.Balance{}, nil
+	}
+	if err != nil {
+		return model.Balance{}, wrapError(err)
+	}
+
+	return bal, nil
+}
+
+func (s *Storage) GetOrderOwner(ctx context.Context, orderNum string) (login string, err error) {
 	selectQuery := `SELECT (login) FROM orders WHERE number = $1`
-	row := s.conn.QueryRow(context.Background(), selectQuery, orderNum)
+	row := s.pool.QueryRow(ctx, selectQuery, orderNum)
 
 	err = row.Scan(&login)
 	if err != nil {
-		return "", err
+		return "", wrapError(err)
 	}
 
 	return login, nil
 }
 
-func (s *Storage) GetUser(login string) (model.User, error) {
+func (s *Storage) GetUser(ctx context.Context, login string) (model.User, error) {
 	query := `SELECT (login, password) FROM users WHERE login = $1`
-	row := s.conn.QueryRow(context.Background(), query, login)
+	row := s.pool.QueryRow(ctx, query, login)
 
 	user := model.User{}
 
 	err := row.Scan(&user)
 	if err != nil {
-		return model.User{}, err
+		return model.User{}, wrapError(err)
 	}
 
 	return user, nil
 }
 
-func (s *Storage) GetOrders(login string) ([]model.Order, error) {
+func (s *Storage) UpdatePassword(ctx context.Context, login, password string) error {
+	query := `UPDATE users SET password = $1 WHERE login = $2`
+	_, err := s.pool.Exec(ctx, query, password, login)
+	return wrapError(err)
+}
+
+func (s *Storage) GetOrders(ctx context.Context, login string) ([]model.Order, error) {
 	countQuery := `SELECT COUNT(*) FROM orders WHERE login = $1`
 	selectQuery := `SELECT (number, status, accrual, uploaded_at) FROM orders WHERE login = $1 ORDER BY uploaded_at`
 
 	var cnt int
-	row := s.conn.QueryRow(context.Background(), countQuery, login)
+	row := s.pool.QueryRow(ctx, countQuery, login)
 
 	err := row.Scan(&cnt)
 	if err != nil {
-		return nil, err
+		return nil, wrapError(err)
 	}
 
-	rows, err := s.conn.Query(context.Background(), selectQuery, login)
+	rows, err := s.pool.Query(ctx, selectQuery, login)
 	if err != nil {
-		return nil, err
+		return nil, wrapError(err)
 	}
+	defer rows.Close()
 
 	orders := make([]model.Order, 0, cnt)
 
@@ -164,95 +203,135 @@ func (s *Storage) GetOrders(login string) ([]model.Order, error) {
 
 		err := rows.Scan(&order)
 		if err != nil {
-			return nil, err
+			return nil, wrapError(err)
 		}
 
 		orders = append(orders, order)
 	}
 
-	return orders, nil
-}
-
-func (s *Storage) GetProcessingOrders() ([]model.Order, error) {
-	countQuery := `SELECT COUNT(*) FROM orders WHERE status IN ($1, $2)`
-	selectQuery := `SELECT (number, status, accrual, uploaded_at) FROM orders WHERE status IN ($1, $2)`
-
-	var cnt int
-	row := s.conn.QueryRow(context.Background(), countQuery, model.OrderStatusNew, model.OrderStatusProcessing)
-
-	err := row.Scan(&cnt)
-	if err != nil {
-		return nil, err
+	if err := rows.Err(); err != nil {
+		return nil, wrapError(err)
 	}
 
-	if cnt == 0 {
-		return nil, errors.New("error: no content to return")
-	}
-
-	rows, err := s.conn.Query(context.Background(), selectQuery, model.OrderStatusNew, model.OrderStatusProcessing)
-	if err != nil {
-		return nil, err
-	}
-
-	orders := make([]model.Order, 0, cnt)
+	return orders, nil
+}
 
-	for rows.Next() {
-		var order model.Order
+// Withdraw locks the user's balance row so concurrent withdrawals can't overdraw the account.
+// The withdrawal is inserted before the balance is checked, so a retry of one that went through
+// gets ErrorWithdrawExists even when the account has been drained since.
+func (s *Storage) Withdraw(ctx context.Context, login string, withdraw model.Withdraw) error {
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		balanceQuery := `SELECT current FROM balances WHERE login = $1 FOR UPDATE`
+
+		var current model.Money
+		err := tx.QueryRow(ctx, balanceQuery, login).Scan(&current)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return err
+		}
 
-		err := rows.Scan(&order)
+		query := `INSERT INTO withdrawals VALUES($1, $2, $3, $4)`
+		_, err = tx.Exec(
+			ctx,
+			query,
+			withdraw.Order,
+			login,
+			withdraw.Sum,
+			time.Now(),
+		)
+		if isUniqueViolation(err) {
+			return model.ErrorWithdrawExists
+		}
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		orders = append(orders, order)
-	}
-
-	return orders, nil
-}
-
-func (s *Storage) Withdraw(login string, withdraw model.Withdraw) error {
-	query := `INSERT INTO withdrawals VALUES($1, $2, $3, $4)`
-	_, err := s.conn.Exec(
-		context.Background(),
-		query,
-		withdraw.Order,
-		login,
-		withdraw.Sum,
-		time.Now(),
-	)
+		if current < withdraw.Sum {
+			return model.ErrorInsufficientFunds
+		}
 
-	return err
+		return addBalance(ctx, tx, login, -withdraw.Sum, withdraw.Sum)
+	})
+	return wrapError(err)
 }
 
-func (s *Storage) GetWithdrawals(login string) ([]model.Withdraw, error) {
+func (s *Storage) GetWithdrawals(ctx context.Context, login string) ([]model.Withdraw, error) {
 	countQuery := `SELECT COUNT(*) FROM withdrawals WHERE login = $1`
 	selectQuery := `SELECT (number, sum, processed_at) FROM withdrawals WHERE login = $1 ORDER BY processed_at`
 
 	var cnt int
-	row := s.conn.QueryRow(context.Background(), countQuery, login)
+	row := s.pool.QueryRow(ctx, countQuery, login)
 
 	err := row.Scan(&cnt)
 	if err != nil {
-		return nil, err
+		return nil, wrapError(err)
 	}
 
 	withdrawals := make([]model.Withdraw, 0, cnt)
 
-	rows, err := s.conn.Query(context.Background(), selectQuery, login)
+	rows, err := s.pool.Query(ctx, selectQuery, login)
 	if err != nil {
-		return nil, err
+		return nil, wrapError(err)
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		var w model.Withdraw
 
 		err := rows.Scan(&w)
 		if err != nil {
-			return nil, err
+			return nil, wrapError(err)
 		}
 
 		withdrawals = append(withdrawals, w)
 	}
 
+	if err := rows.Err(); err != nil {
+		return nil, wrapError(err)
+	}
+
 	return withdrawals, nil
 }
+
+// wrapError classifies driver errors as repository errors, the original error stays in the chain.
+func wrapError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, model.ErrorNotFound), errors.Is(err, model.ErrorConflict), errors.Is(err, model.ErrorUnavailable):
+		return err
+	case errors.Is(err, pgx.ErrNoRows):
+		return fmt.Errorf("%w: %w", model.ErrorNotFound, err)
+	case isUniqueViolation(err):
+		return fmt.Errorf("%w: %w", model.ErrorConflict, err)
+	case isTransient(err):
+		return fmt.Errorf("%w: %w", model.ErrorUnavailable, err)
+	default:
+		return err
+	}
+}
+
+// isTransient reports errors caused by the database being unreachable or overloaded rather than by the query.
+func isTransient(err error) bool {
+	if pgconn.Timeout(err) || pgconn.SafeToRetry(err) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code[:2] {
+		case "08", // connection exception
+			"53", // insufficient resources
+			"57": // operator intervention, e.g. shutdown or statement timeout
+			return true
+		}
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
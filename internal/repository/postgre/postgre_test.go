@@ -0,0 +1,356 @@
+package postgre
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/auth"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/model"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/repository/repotest"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/testdb"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestStorage migrates a fresh schema of the TEST_DATABASE_URI database, so tests see only
+// their own rows and leave nothing behind.
+func newTestStorage(t *testing.T) *Storage {
+	t.Helper()
+
+	pool := testdb.Pool(t)
+
+	migrator, err := NewMigrator(pool)
+	require.NoError(t, err)
+
+	_, err = migrator.Up(context.Background())
+	require.NoError(t, err)
+
+	return NewStorage(pool)
+}
+
+func TestStorage_Contract(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) repotest.Repository {
+		return newTestStorage(t)
+	})
+}
+
+func TestStorage_WithdrawConcurrent(t *testing.T) {
+	const (
+		withdrawals = 300
+		accrual     = model.Money(10000)
+		sum         = model.Money(100)
+	)
+
+	storage := newTestStorage(t)
+	ctx := context.Background()
+
+	suffix := time.Now().UnixNano()
+	login := fmt.Sprintf("withdraw-race-%d", suffix)
+	orderNum := fmt.Sprintf("%d", suffix)
+
+	require.NoError(t, storage.Create(ctx, model.User{Login: login, Password: "secret"}))
+	require.NoError(t, storage.UpdateOrder(ctx, login, model.Order{Number: orderNum}))
+
+	amount := accrual
+	require.NoError(t, storage.UpdateOrder(ctx, login, model.Order{
+		Number:  orderNum,
+		Status:  model.OrderStatusProcessed,
+		Accrual: &amount,
+	}))
+
+	var succeeded, rejected atomic.Int64
+	var wg sync.WaitGroup
+
+	for i := 0; i < withdrawals; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := storage.Withdraw(ctx, login, model.Withdraw{
+				Order: fmt.Sprintf("%d-%d", suffix, i),
+				Sum:   sum,
+			})
+			switch {
+			case err == nil:
+				succeeded.Add(1)
+			case errors.Is(err, model.ErrorInsufficientFunds):
+				rejected.Add(1)
+			default:
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	require.Equal(t, int64(accrual/sum), succeeded.Load())
+	require.Equal(t, int64(withdrawals)-succeeded.Load(), rejected.Load())
+
+	bal, err := storage.GetBalance(ctx, login)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, bal.Current, model.Money(0))
+	require.Equal(t, model.Money(0), bal.Current)
+	require.Equal(t, accrual, bal.Withdrawn)
+}
+
+func TestStorage_CreateConcurrent(t *testing.T) {
+	const registrations = 20
+
+	storage := newTestStorage(t)
+	ctx := context.Background()
+
+	login := fmt.Sprintf("register-race-%d", time.Now().UnixNano())
+
+	var created, conflicts atomic.Int64
+	var wg sync.WaitGroup
+
+	for i := 0; i < registrations; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := storage.Create(ctx, model.User{Login: login, Password: "secret"})
+			switch {
+			case err == nil:
+				created.Add(1)
+			case errors.Is(err, model.ErrorUserExists):
+				conflicts.Add(1)
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, int64(1), created.Load())
+	require.Equal(t, int64(registrations-1), conflicts.Load())
+}
+
+func TestStorage_UpdateOrderConcurrent(t *testing.T) {
+	const uploads = 20
+
+	storage := newTestStorage(t)
+	ctx := context.Background()
+
+	logins := []string{
+		fmt.Sprintf("upload-race-a-%d", time.Now().UnixNano()),
+		fmt.Sprintf("upload-race-b-%d", time.Now().UnixNano()),
+	}
+	for _, login := range logins {
+		require.NoError(t, storage.Create(ctx, model.User{Login: login, Password: "secret"}))
+	}
+
+	number := "79927398713"
+	var created, uploaded, foreign atomic.Int64
+	var wg sync.WaitGroup
+
+	for i := 0; i < uploads; i++ {
+		wg.Add(1)
+		go func(login string) {
+			defer wg.Done()
+			err := storage.UpdateOrder(ctx, login, model.Order{Number: number})
+			switch {
+			case err == nil:
+				created.Add(1)
+			case errors.Is(err, model.ErrorOrderUploaded):
+				uploaded.Add(1)
+			case errors.Is(err, model.ErrorOrderOfAnotherUser):
+				foreign.Add(1)
+			default:
+				t.Error(err)
+			}
+		}(logins[i%len(logins)])
+	}
+	wg.Wait()
+
+	require.Equal(t, int64(1), created.Load())
+	require.Equal(t, int64(uploads/2-1), uploaded.Load())
+	require.Equal(t, int64(uploads/2), foreign.Load())
+}
+
+func TestStorage_ReserveLoginAttemptConcurrent(t *testing.T) {
+	const attempts = 30
+
+	storage := newTestStorage(t)
+	guard := auth.NewLoginGuard(storage, auth.LockoutPolicy{
+		FreeAttempts: 2,
+		BaseDelay:    time.Minute,
+		MaxDelay:     time.Hour,
+		Window:       time.Hour,
+	}, auth.DefaultIPLockout)
+
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait, err := guard.Attempt(context.Background(), "guess-race", "10.0.0.1")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if wait == 0 {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the free attempts and the one locking the login
+	require.Equal(t, int64(3), allowed.Load())
+}
+
+func TestStorage_ReserveLoginAttemptLongLogin(t *testing.T) {
+	storage := newTestStorage(t)
+	ctx := context.Background()
+	guard := auth.NewLoginGuard(storage, auth.LockoutPolicy{
+		FreeAttempts: 1,
+		BaseDelay:    time.Minute,
+		MaxDelay:     time.Hour,
+		Window:       time.Hour,
+	}, auth.DefaultIPLockout)
+
+	login := strings.Repeat("x", 1000)
+	for i := 0; i < 2; i++ {
+		wait, err := guard.Attempt(ctx, login, "10.0.0.1")
+		require.NoError(t, err)
+		require.Zero(t, wait)
+	}
+
+	wait, err := guard.Attempt(ctx, login, "10.0.0.1")
+	require.NoError(t, err)
+	require.Positive(t, wait)
+
+	var events int
+	err = storage.pool.QueryRow(ctx, "SELECT COUNT(*) FROM lockout_events WHERE login = $1", login[:255]).Scan(&events)
+	require.NoError(t, err)
+	require.Equal(t, 1, events)
+
+	require.NoError(t, guard.Succeed(ctx, login, "10.0.0.1"))
+}
+
+// useLocalZone runs the test as if the process was in a zone west of UTC.
+func useLocalZone(t *testing.T) {
+	t.Helper()
+
+	local := time.Local
+	time.Local = time.FixedZone("UTC-5", -5*60*60)
+	t.Cleanup(func() { time.Local = local })
+}
+
+func TestStorage_UploadedAtOutsideUTC(t *testing.T) {
+	useLocalZone(t)
+
+	storage := newTestStorage(t)
+	ctx := context.Background()
+
+	login := fmt.Sprintf("zone-%d", time.Now().UnixNano())
+	require.NoError(t, storage.Create(ctx, model.User{Login: login, Password: "secret"}))
+	require.NoError(t, storage.UpdateOrder(ctx, login, model.Order{Number: "79927398713"}))
+
+	jobs, err := storage.LeaseAccrualJobs(ctx, time.Now(), 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	require.WithinDuration(t, time.Now(), jobs[0].Order.UploadedAt, time.Minute)
+}
+
+func TestStorage_RotateRefreshTokenOutsideUTC(t *testing.T) {
+	useLocalZone(t)
+
+	storage := newTestStorage(t)
+	ctx := context.Background()
+
+	login := fmt.Sprintf("zone-%d", time.Now().UnixNano())
+	require.NoError(t, storage.Create(ctx, model.User{Login: login, Password: "secret"}))
+
+	require.NoError(t, storage.SaveRefreshToken(ctx, login, login+"-active", time.Now().Add(time.Hour)))
+	rotated, err := storage.RotateRefreshToken(ctx, login+"-active", login+"-next", time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, login, rotated)
+
+	require.NoError(t, storage.SaveRefreshToken(ctx, login, login+"-expired", time.Now().Add(-time.Minute)))
+	_, err = storage.RotateRefreshToken(ctx, login+"-expired", login+"-other", time.Now().Add(time.Hour))
+	require.ErrorIs(t, err, model.ErrorRefreshTokenInvalid)
+}
+
+func TestStorage_Reconcile(t *testing.T) {
+	storage := newTestStorage(t)
+	ctx := context.Background()
+
+	login := fmt.Sprintf("reconcile-%d", time.Now().UnixNano())
+	require.NoError(t, storage.Create(ctx, model.User{Login: login, Password: "secret"}))
+	require.NoError(t, storage.UpdateOrder(ctx, login, model.Order{Number: "79927398713"}))
+
+	accrual := model.Money(10000)
+	require.NoError(t, storage.UpdateOrder(ctx, login, model.Order{Number: "79927398713", Status: model.OrderStatusProcessed, Accrual: &accrual}))
+	require.NoError(t, storage.Withdraw(ctx, login, model.Withdraw{Order: "2377225624", Sum: 2500}))
+
+	mismatches, err := storage.Reconcile(ctx, false)
+	require.NoError(t, err)
+	require.Empty(t, mismatches)
+
+	_, err = storage.pool.Exec(ctx, `UPDATE balances SET current = current + 100 WHERE login = $1`, login)
+	require.NoError(t, err)
+
+	want := []Mismatch{{
+		Login:    login,
+		Stored:   model.Balance{Current: 7600, Withdrawn: 2500},
+		Expected: model.Balance{Current: 7500, Withdrawn: 2500},
+	}}
+
+	mismatches, err = storage.Reconcile(ctx, false)
+	require.NoError(t, err)
+	require.Equal(t, want, mismatches)
+
+	// reporting alone leaves the drift in place
+	bal, err := storage.GetBalance(ctx, login)
+	require.NoError(t, err)
+	require.Equal(t, model.Balance{Current: 7600, Withdrawn: 2500}, bal)
+
+	mismatches, err = storage.Reconcile(ctx, true)
+	require.NoError(t, err)
+	require.Equal(t, want, mismatches)
+
+	bal, err = storage.GetBalance(ctx, login)
+	require.NoError(t, err)
+	require.Equal(t, model.Balance{Current: 7500, Withdrawn: 2500}, bal)
+
+	mismatches, err = storage.Reconcile(ctx, false)
+	require.NoError(t, err)
+	require.Empty(t, mismatches)
+}
+
+func TestWrapError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{name: "no_rows", err: pgx.ErrNoRows, want: model.ErrorNotFound},
+		{name: "unique_violation", err: &pgconn.PgError{Code: "23505"}, want: model.ErrorConflict},
+		{name: "admin_shutdown", err: &pgconn.PgError{Code: "57P01"}, want: model.ErrorUnavailable},
+		{name: "connection_failure", err: &pgconn.PgError{Code: "08006"}, want: model.ErrorUnavailable},
+		{name: "network", err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}, want: model.ErrorUnavailable},
+		{name: "deadline", err: fmt.Errorf("query: %w", context.DeadlineExceeded), want: model.ErrorUnavailable},
+		{name: "domain_error", err: model.ErrorInsufficientFunds, want: model.ErrorInsufficientFunds},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := wrapError(tt.err)
+			require.ErrorIs(t, err, tt.want)
+			require.ErrorIs(t, err, tt.err)
+		})
+	}
+
+	require.NoError(t, wrapError(nil))
+
+	err := wrapError(&pgconn.PgError{Code: "42601"})
+	require.False(t, errors.Is(err, model.ErrorUnavailable))
+	require.False(t, errors.Is(err, model.ErrorConflict))
+}
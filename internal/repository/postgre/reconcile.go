@@ -0,0 +1,79 @@
+package postgre
+
+import (
+	"context"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/model"
+	"github.com/jackc/pgx/v5"
+)
+
+// Mismatch is a user whose stored balance differs from the one recomputed from history.
+type Mismatch struct {
+	Login    string
+	Stored   model.Balance
+	Expected model.Balance
+}
+
+// Reconcile recomputes balances from orders and withdrawals and reports every mismatch.
+// When fix is true stored balances are overwritten with the recomputed values.
+func (s *Storage) Reconcile(ctx context.Context, fix bool) ([]Mismatch, error) {
+	var mismatches []Mismatch
+
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		if fix {
+			_, err := tx.Exec(ctx, `LOCK TABLE balances IN EXCLUSIVE MODE`)
+			if err != nil {
+				return err
+			}
+		}
+
+		query := `SELECT h.login, h.current, h.withdrawn, COALESCE(b.current, 0), COALESCE(b.withdrawn, 0)
+FROM (` + historyBalanceQuery + `) AS h (login, current, withdrawn)
+LEFT JOIN balances b ON b.login = h.login
+ORDER BY h.login`
+
+		rows, err := tx.Query(ctx, query)
+		if err != nil {
+			return err
+		}
+
+		for rows.Next() {
+			var m Mismatch
+
+			err := rows.Scan(&m.Login, &m.Expected.Current, &m.Expected.Withdrawn, &m.Stored.Current, &m.Stored.Withdrawn)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+
+			if m.Stored != m.Expected {
+				mismatches = append(mismatches, m)
+			}
+		}
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if !fix {
+			return nil
+		}
+
+		fixQuery := `INSERT INTO balances (login, current, withdrawn) VALUES ($1, $2, $3)
+ON CONFLICT (login) DO UPDATE SET current = EXCLUDED.current, withdrawn = EXCLUDED.withdrawn`
+
+		for _, m := range mismatches {
+			_, err := tx.Exec(ctx, fixQuery, m.Login, m.Expected.Current, m.Expected.Withdrawn)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return mismatches, nil
+}
@@ -0,0 +1,141 @@
+package postgre
+
+import (
+	"context"
+	"errors"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/model"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+func (s *Storage) SaveRefreshToken(ctx context.Context, login, hash string, expiresAt time.Time) error {
+	query := `INSERT INTO refresh_tokens (token_hash, login, created_at, expires_at) VALUES ($1, $2, $3, $4)`
+	_, err := s.pool.Exec(ctx, query, hash, login, time.Now(), expiresAt)
+	return wrapError(err)
+}
+
+// RotateRefreshToken revokes the presented refresh token and stores its replacement.
+// Presenting an already revoked token is treated as theft and revokes every session of the user.
+func (s *Storage) RotateRefreshToken(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (string, error) {
+	var login string
+	var reused bool
+
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		now := time.Now()
+
+		var revokedAt *time.Time
+		var active bool
+
+		selectQuery := `SELECT login, expires_at > $2, revoked_at FROM refresh_tokens WHERE token_hash = $1 FOR UPDATE`
+		err := tx.QueryRow(ctx, selectQuery, oldHash, now).Scan(&login, &active, &revokedAt)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return model.ErrorRefreshTokenInvalid
+		}
+		if err != nil {
+			return err
+		}
+
+		if revokedAt != nil {
+			reused = true
+			return nil
+		}
+
+		if !active {
+			return model.ErrorRefreshTokenInvalid
+		}
+
+		revokeQuery := `UPDATE refresh_tokens SET revoked_at = $1 WHERE token_hash = $2`
+		_, err = tx.Exec(ctx, revokeQuery, now, oldHash)
+		if err != nil {
+			return err
+		}
+
+		insertQuery := `INSERT INTO refresh_tokens (token_hash, login, created_at, expires_at) VALUES ($1, $2, $3, $4)`
+		_, err = tx.Exec(ctx, insertQuery, newHash, login, now, expiresAt)
+		return err
+	})
+	if err != nil {
+		return "", wrapError(err)
+	}
+
+	if reused {
+		if err := s.RevokeAllTokens(ctx, login); err != nil {
+			return "", wrapError(err)
+		}
+		return "", model.ErrorRefreshTokenInvalid
+	}
+
+	return login, nil
+}
+
+func (s *Storage) RevokeRefreshToken(ctx context.Context, login, hash string) error {
+	query := `UPDATE refresh_tokens SET revoked_at = $1 WHERE token_hash = $2 AND login = $3 AND revoked_at IS NULL`
+	_, err := s.pool.Exec(ctx, query, time.Now(), hash, login)
+	return wrapError(err)
+}
+
+// RevokeAccessToken keeps the jti on the revocation list until the token would have expired anyway.
+func (s *Storage) RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	query := `INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING`
+	_, err := s.pool.Exec(ctx, query, jti, expiresAt)
+	return wrapError(err)
+}
+
+// RevokeAllTokens invalidates every access token issued before the current second and every refresh token
+// of the user. The mark is kept to the second like the iat claim, so a token issued in the same second
+// by the next login stays valid.
+func (s *Storage) RevokeAllTokens(ctx context.Context, login string) error {
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		now := time.Now()
+
+		userQuery := `UPDATE users SET tokens_revoked_at = $1 WHERE login = $2`
+		_, err := tx.Exec(ctx, userQuery, now.Truncate(time.Second), login)
+		if err != nil {
+			return err
+		}
+
+		refreshQuery := `UPDATE refresh_tokens SET revoked_at = $1 WHERE login = $2 AND revoked_at IS NULL`
+		_, err = tx.Exec(ctx, refreshQuery, now, login)
+		return err
+	})
+	return wrapError(err)
+}
+
+// IsAccessTokenRevoked checks the jti revocation list and the user's "log out all devices" mark
+// with a single round trip over primary keys.
+func (s *Storage) IsAccessTokenRevoked(ctx context.Context, jti, login string, issuedAt time.Time) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $1)
+	OR EXISTS (SELECT 1 FROM users WHERE login = $2 AND tokens_revoked_at > $3)`
+
+	var revoked bool
+	err := s.pool.QueryRow(ctx, query, jti, login, issuedAt).Scan(&revoked)
+	if err != nil {
+		return false, wrapError(err)
+	}
+
+	return revoked, nil
+}
+
+func (s *Storage) DeleteExpiredTokens(ctx context.Context) (int64, error) {
+	var deleted int64
+
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		now := time.Now()
+
+		tag, err := tx.Exec(ctx, `DELETE FROM revoked_tokens WHERE expires_at <= $1`, now)
+		if err != nil {
+			return err
+		}
+		deleted += tag.RowsAffected()
+
+		tag, err = tx.Exec(ctx, `DELETE FROM refresh_tokens WHERE expires_at <= $1`, now)
+		if err != nil {
+			return err
+		}
+		deleted += tag.RowsAffected()
+
+		return nil
+	})
+
+	return deleted, wrapError(err)
+}
@@ -0,0 +1,730 @@
+// Package repotest is the contract every repository implementation must satisfy.
+// Backends call Run from their own tests with a constructor for a ready to use storage,
+// every call must return a storage that doesn't share orders with the others.
+package repotest
+
+import (
+	"context"
+	"fmt"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/model"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type Repository interface {
+	Create(ctx context.Context, user model.User) error
+	UpdateOrder(ctx context.Context, login string, order model.Order) error
+	GetOrderOwner(ctx context.Context, orderNum string) (login string, err error)
+	GetUser(ctx context.Context, login string) (model.User, error)
+	UpdatePassword(ctx context.Context, login, password string) error
+	GetOrders(ctx context.Context, login string) ([]model.Order, error)
+	GetBalance(ctx context.Context, login string) (model.Balance, error)
+	Withdraw(ctx context.Context, login string, withdraw model.Withdraw) error
+	GetWithdrawals(ctx context.Context, login string) ([]model.Withdraw, error)
+	LeaseAccrualJobs(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]model.AccrualJob, error)
+	RescheduleAccrualJob(ctx context.Context, number string, nextPollAt time.Time) error
+	GetIdempotentResponse(ctx context.Context, login, key string) (model.IdempotentResponse, bool, error)
+	ReserveIdempotencyKey(ctx context.Context, login, key, requestHash string, ttl time.Duration) (model.IdempotentResponse, bool, error)
+	ReleaseIdempotencyKey(ctx context.Context, login, key string) error
+	SaveIdempotentResponse(ctx context.Context, login, key string, resp model.IdempotentResponse, ttl time.Duration) error
+	SaveRefreshToken(ctx context.Context, login, hash string, expiresAt time.Time) error
+	RotateRefreshToken(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (string, error)
+	RevokeRefreshToken(ctx context.Context, login, hash string) error
+	RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error
+	RevokeAllTokens(ctx context.Context, login string) error
+	IsAccessTokenRevoked(ctx context.Context, jti, login string, issuedAt time.Time) (bool, error)
+}
+
+var counter atomic.Int64
+
+// unique returns a value no other test has used, so backends sharing a database don't collide.
+func unique(prefix string) string {
+	return fmt.Sprintf("%s-%d-%d", prefix, time.Now().UnixNano(), counter.Add(1))
+}
+
+func money(v model.Money) *model.Money {
+	return &v
+}
+
+// Run executes the whole contract, newRepository is called once per test.
+func Run(t *testing.T, newRepository func(t *testing.T) Repository) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, storage Repository)
+	}{
+		{name: "Users", test: testUsers},
+		{name: "UpdateOrder", test: testUpdateOrder},
+		{name: "OrderTransitions", test: testOrderTransitions},
+		{name: "GetOrders", test: testGetOrders},
+		{name: "DueOrders", test: testDueOrders},
+		{name: "AccrualJobs", test: testAccrualJobs},
+		{name: "Balance", test: testBalance},
+		{name: "BalanceLedger", test: testBalanceLedger},
+		{name: "Withdraw", test: testWithdraw},
+		{name: "WithdrawRetryDrained", test: testWithdrawRetryDrained},
+		{name: "GetWithdrawals", test: testGetWithdrawals},
+		{name: "Idempotency", test: testIdempotency},
+		{name: "IdempotencyReservation", test: testIdempotencyReservation},
+		{name: "RefreshTokens", test: testRefreshTokens},
+		{name: "AccessTokens", test: testAccessTokens},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newRepository(t))
+		})
+	}
+}
+
+func newUser(t *testing.T, storage Repository) string {
+	t.Helper()
+
+	login := unique("user")
+	require.NoError(t, storage.Create(context.Background(), model.User{Login: login, Password: "hash"}))
+	return login
+}
+
+func testUsers(t *testing.T, storage Repository) {
+	ctx := context.Background()
+	login := unique("user")
+
+	_, err := storage.GetUser(ctx, login)
+	require.ErrorIs(t, err, model.ErrorNotFound)
+
+	require.NoError(t, storage.Create(ctx, model.User{Login: login, Password: "hash"}))
+
+	err = storage.Create(ctx, model.User{Login: login, Password: "other"})
+	require.ErrorIs(t, err, model.ErrorUserExists)
+	require.ErrorIs(t, err, model.ErrorConflict)
+
+	user, err := storage.GetUser(ctx, login)
+	require.NoError(t, err)
+	require.Equal(t, model.User{Login: login, Password: "hash"}, user)
+
+	require.NoError(t, storage.UpdatePassword(ctx, login, "new-hash"))
+	user, err = storage.GetUser(ctx, login)
+	require.NoError(t, err)
+	require.Equal(t, "new-hash", user.Password)
+
+	bal, err := storage.GetBalance(ctx, login)
+	require.NoError(t, err)
+	require.Equal(t, model.Balance{}, bal)
+}
+
+func testUpdateOrder(t *testing.T, storage Repository) {
+	ctx := context.Background()
+	owner := newUser(t, storage)
+	other := newUser(t, storage)
+	number := unique("order")
+
+	_, err := storage.GetOrderOwner(ctx, number)
+	require.ErrorIs(t, err, model.ErrorNotFound)
+
+	require.NoError(t, storage.UpdateOrder(ctx, owner, model.Order{Number: number}))
+
+	login, err := storage.GetOrderOwner(ctx, number)
+	require.NoError(t, err)
+	require.Equal(t, owner, login)
+
+	err = storage.UpdateOrder(ctx, owner, model.Order{Number: number})
+	require.ErrorIs(t, err, model.ErrorOrderUploaded)
+
+	err = storage.UpdateOrder(ctx, other, model.Order{Number: number})
+	require.ErrorIs(t, err, model.ErrorOrderOfAnotherUser)
+	require.ErrorIs(t, err, model.ErrorConflict)
+
+	orders, err := storage.GetOrders(ctx, owner)
+	require.NoError(t, err)
+	require.Len(t, orders, 1)
+	require.Equal(t, number, orders[0].Number)
+	require.Equal(t, model.OrderStatusNew, orders[0].Status)
+	require.Nil(t, orders[0].Accrual)
+	require.False(t, orders[0].UploadedAt.IsZero())
+
+	orders, err = storage.GetOrders(ctx, other)
+	require.NoError(t, err)
+	require.Empty(t, orders)
+}
+
+func testOrderTransitions(t *testing.T, storage Repository) {
+	ctx := context.Background()
+	login := newUser(t, storage)
+
+	tests := []struct {
+		name    string
+		updates []string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "new_again",
+			updates: []string{model.OrderStatusNew},
+			want:    model.OrderStatusNew,
+		},
+		{
+			name:    "processing_to_processed",
+			updates: []string{model.OrderStatusProcessing, model.OrderStatusProcessing, model.OrderStatusProcessed},
+			want:    model.OrderStatusProcessed,
+		},
+		{
+			name:    "new_to_invalid",
+			updates: []string{model.OrderStatusInvalid},
+			want:    model.OrderStatusInvalid,
+		},
+		{
+			name:    "back_to_new",
+			updates: []string{model.OrderStatusProcessing, model.OrderStatusNew},
+			want:    model.OrderStatusProcessing,
+			wantErr: true,
+		},
+		{
+			name:    "invalid_is_final",
+			updates: []string{model.OrderStatusInvalid, model.OrderStatusProcessing},
+			want:    model.OrderStatusInvalid,
+			wantErr: true,
+		},
+		{
+			name:    "processed_is_final",
+			updates: []string{model.OrderStatusProcessed, model.OrderStatusInvalid},
+			want:    model.OrderStatusProcessed,
+			wantErr: true,
+		},
+		{
+			name:    "unknown_status",
+			updates: []string{"REGISTERED"},
+			want:    model.OrderStatusNew,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			number := unique("order")
+			require.NoError(t, storage.UpdateOrder(ctx, login, model.Order{Number: number}))
+
+			var err error
+			for _, status := range tt.updates {
+				err = storage.UpdateOrder(ctx, login, model.Order{Number: number, Status: status})
+				if err != nil {
+					break
+				}
+			}
+
+			if tt.wantErr {
+				require.ErrorIs(t, err, model.ErrorOrderTransition)
+				require.ErrorIs(t, err, model.ErrorConflict)
+			} else {
+				require.NoError(t, err)
+			}
+
+			orders, err := storage.GetOrders(ctx, login)
+			require.NoError(t, err)
+
+			statuses := make(map[string]string)
+			for _, order := range orders {
+				statuses[order.Number] = order.Status
+			}
+			require.Equal(t, tt.want, statuses[number])
+		})
+	}
+}
+
+func testGetOrders(t *testing.T, storage Repository) {
+	ctx := context.Background()
+	login := newUser(t, storage)
+	other := newUser(t, storage)
+
+	numbers := []string{unique("order-c"), unique("order-a"), unique("order-b")}
+	for _, number := range numbers {
+		require.NoError(t, storage.UpdateOrder(ctx, login, model.Order{Number: number}))
+		time.Sleep(time.Millisecond)
+	}
+	require.NoError(t, storage.UpdateOrder(ctx, other, model.Order{Number: unique("order")}))
+
+	// updating an order keeps its place
+	require.NoError(t, storage.UpdateOrder(ctx, login, model.Order{Number: numbers[0], Status: model.OrderStatusProcessed, Accrual: money(100)}))
+
+	orders, err := storage.GetOrders(ctx, login)
+	require.NoError(t, err)
+	require.Len(t, orders, len(numbers))
+
+	for i, order := range orders {
+		require.Equal(t, numbers[i], order.Number)
+		if i > 0 {
+			require.False(t, order.UploadedAt.Before(orders[i-1].UploadedAt))
+		}
+	}
+
+	orders, err = storage.GetOrders(ctx, newUser(t, storage))
+	require.NoError(t, err)
+	require.NotNil(t, orders)
+	require.Empty(t, orders)
+}
+
+func testDueOrders(t *testing.T, storage Repository) {
+	ctx := context.Background()
+	login := newUser(t, storage)
+
+	statuses := map[string]string{
+		unique("new"):        "",
+		unique("processing"): model.OrderStatusProcessing,
+		unique("processed"):  model.OrderStatusProcessed,
+		unique("invalid"):    model.OrderStatusInvalid,
+	}
+	for number, status := range statuses {
+		require.NoError(t, storage.UpdateOrder(ctx, login, model.Order{Number: number}))
+		if status != "" {
+			require.NoError(t, storage.UpdateOrder(ctx, login, model.Order{Number: number, Status: status}))
+		}
+	}
+
+	now := time.Now().Add(time.Second)
+
+	// orders in a final status aren't polled
+	jobs, err := storage.LeaseAccrualJobs(ctx, now, 10, time.Minute)
+	require.NoError(t, err)
+
+	got := make(map[string]string)
+	for _, job := range jobs {
+		got[job.Order.Number] = job.Order.Status
+	}
+
+	want := make(map[string]string)
+	for number, status := range statuses {
+		switch status {
+		case "":
+			want[number] = model.OrderStatusNew
+		case model.OrderStatusProcessing:
+			want[number] = status
+		}
+	}
+	require.Equal(t, want, got)
+
+	// the batch limit takes the jobs due first
+	var first string
+	for number := range want {
+		next := now.Add(2 * time.Hour)
+		if first == "" {
+			first = number
+			next = now.Add(time.Hour)
+		}
+		require.NoError(t, storage.RescheduleAccrualJob(ctx, number, next))
+	}
+
+	jobs, err = storage.LeaseAccrualJobs(ctx, now.Add(3*time.Hour), 1, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{first: 2}, leased(jobs))
+
+	jobs, err = storage.LeaseAccrualJobs(ctx, now.Add(3*time.Hour), 1, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	require.NotEqual(t, first, jobs[0].Order.Number)
+}
+
+func leased(jobs []model.AccrualJob) map[string]int {
+	res := make(map[string]int)
+	for _, job := range jobs {
+		res[job.Order.Number] = job.Attempts
+	}
+	return res
+}
+
+func testAccrualJobs(t *testing.T, storage Repository) {
+	ctx := context.Background()
+	login := newUser(t, storage)
+	first, second := unique("order"), unique("order")
+
+	require.NoError(t, storage.UpdateOrder(ctx, login, model.Order{Number: first}))
+	require.NoError(t, storage.UpdateOrder(ctx, login, model.Order{Number: second}))
+
+	now := time.Now().Add(time.Second)
+
+	jobs, err := storage.LeaseAccrualJobs(ctx, now, 10, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{first: 1, second: 1}, leased(jobs))
+	for _, job := range jobs {
+		require.Equal(t, model.OrderStatusNew, job.Order.Status)
+		require.False(t, job.Order.UploadedAt.IsZero())
+	}
+
+	// leased jobs aren't handed out twice
+	jobs, err = storage.LeaseAccrualJobs(ctx, now, 10, time.Minute)
+	require.NoError(t, err)
+	require.Empty(t, jobs)
+
+	require.NoError(t, storage.RescheduleAccrualJob(ctx, first, now.Add(time.Hour)))
+
+	// an expired lease makes the job due again, the rescheduled one waits
+	jobs, err = storage.LeaseAccrualJobs(ctx, now.Add(2*time.Minute), 10, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{second: 2}, leased(jobs))
+
+	// a final status removes the job
+	require.NoError(t, storage.UpdateOrder(ctx, login, model.Order{Number: second, Status: model.OrderStatusInvalid}))
+	require.NoError(t, storage.RescheduleAccrualJob(ctx, second, now))
+
+	jobs, err = storage.LeaseAccrualJobs(ctx, now.Add(2*time.Hour), 10, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{first: 2}, leased(jobs))
+
+	// a status change starts the attempts over
+	require.NoError(t, storage.UpdateOrder(ctx, login, model.Order{Number: first, Status: model.OrderStatusProcessing}))
+	require.NoError(t, storage.RescheduleAccrualJob(ctx, first, now))
+
+	jobs, err = storage.LeaseAccrualJobs(ctx, now.Add(2*time.Hour), 10, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{first: 1}, leased(jobs))
+	require.Equal(t, model.OrderStatusProcessing, jobs[0].Order.Status)
+
+	// concurrent pollers never lease the same job
+	require.NoError(t, storage.RescheduleAccrualJob(ctx, first, now))
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	total := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			jobs, err := storage.LeaseAccrualJobs(ctx, now.Add(3*time.Hour), 10, time.Minute)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			mu.Lock()
+			total += len(jobs)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 1, total)
+}
+
+func testBalance(t *testing.T, storage Repository) {
+	ctx := context.Background()
+	login := newUser(t, storage)
+	number := unique("order")
+
+	require.NoError(t, storage.UpdateOrder(ctx, login, model.Order{Number: number}))
+	require.NoError(t, storage.UpdateOrder(ctx, login, model.Order{Number: number, Status: model.OrderStatusProcessing}))
+
+	bal, err := storage.GetBalance(ctx, login)
+	require.NoError(t, err)
+	require.Equal(t, model.Balance{}, bal)
+
+	require.NoError(t, storage.UpdateOrder(ctx, login, model.Order{Number: number, Status: model.OrderStatusProcessed, Accrual: money(72998)}))
+
+	bal, err = storage.GetBalance(ctx, login)
+	require.NoError(t, err)
+	require.Equal(t, model.Balance{Current: 72998}, bal)
+
+	// a processed order is final, its accrual can't be credited twice
+	err = storage.UpdateOrder(ctx, login, model.Order{Number: number, Status: model.OrderStatusProcessed, Accrual: money(50000)})
+	require.ErrorIs(t, err, model.ErrorOrderTransition)
+
+	bal, err = storage.GetBalance(ctx, login)
+	require.NoError(t, err)
+	require.Equal(t, model.Balance{Current: 72998}, bal)
+
+	orders, err := storage.GetOrders(ctx, login)
+	require.NoError(t, err)
+	require.Len(t, orders, 1)
+	require.Equal(t, model.OrderStatusProcessed, orders[0].Status)
+	require.Equal(t, money(72998), orders[0].Accrual)
+}
+
+// testBalanceLedger checks that the stored balance follows the order and withdrawal history.
+func testBalanceLedger(t *testing.T, storage Repository) {
+	ctx := context.Background()
+	login := newUser(t, storage)
+
+	requireHistory := func(want model.Balance) {
+		t.Helper()
+
+		bal, err := storage.GetBalance(ctx, login)
+		require.NoError(t, err)
+		require.Equal(t, want, bal)
+
+		orders, err := storage.GetOrders(ctx, login)
+		require.NoError(t, err)
+		withdrawals, err := storage.GetWithdrawals(ctx, login)
+		require.NoError(t, err)
+
+		var history model.Balance
+		for _, order := range orders {
+			if order.Accrual != nil {
+				history.Current += *order.Accrual
+			}
+		}
+		for _, w := range withdrawals {
+			history.Current -= w.Sum
+			history.Withdrawn += w.Sum
+		}
+		require.Equal(t, history, bal)
+	}
+
+	first, second := unique("order"), unique("order")
+	require.NoError(t, storage.UpdateOrder(ctx, login, model.Order{Number: first}))
+	require.NoError(t, storage.UpdateOrder(ctx, login, model.Order{Number: second}))
+
+	require.NoError(t, storage.UpdateOrder(ctx, login, model.Order{Number: first, Status: model.OrderStatusProcessed, Accrual: money(50000)}))
+	requireHistory(model.Balance{Current: 50000})
+
+	// the accrual of an order still processing is credited by the difference once it changes
+	require.NoError(t, storage.UpdateOrder(ctx, login, model.Order{Number: second, Status: model.OrderStatusProcessing, Accrual: money(1000)}))
+	requireHistory(model.Balance{Current: 51000})
+
+	require.NoError(t, storage.UpdateOrder(ctx, login, model.Order{Number: second, Status: model.OrderStatusProcessed, Accrual: money(2550)}))
+	requireHistory(model.Balance{Current: 52550})
+
+	require.NoError(t, storage.Withdraw(ctx, login, model.Withdraw{Order: unique("withdrawal"), Sum: 12550}))
+	requireHistory(model.Balance{Current: 40000, Withdrawn: 12550})
+}
+
+func testWithdraw(t *testing.T, storage Repository) {
+	ctx := context.Background()
+	login := newUser(t, storage)
+	number := unique("order")
+
+	require.NoError(t, storage.UpdateOrder(ctx, login, model.Order{Number: number}))
+	require.NoError(t, storage.UpdateOrder(ctx, login, model.Order{Number: number, Status: model.OrderStatusProcessed, Accrual: money(1000)}))
+
+	withdrawal := unique("withdrawal")
+
+	err := storage.Withdraw(ctx, login, model.Withdraw{Order: withdrawal, Sum: 1001})
+	require.ErrorIs(t, err, model.ErrorInsufficientFunds)
+
+	require.NoError(t, storage.Withdraw(ctx, login, model.Withdraw{Order: withdrawal, Sum: 750}))
+
+	err = storage.Withdraw(ctx, login, model.Withdraw{Order: withdrawal, Sum: 10})
+	require.ErrorIs(t, err, model.ErrorWithdrawExists)
+	require.ErrorIs(t, err, model.ErrorConflict)
+
+	bal, err := storage.GetBalance(ctx, login)
+	require.NoError(t, err)
+	require.Equal(t, model.Balance{Current: 250, Withdrawn: 750}, bal)
+
+	withdrawals, err := storage.GetWithdrawals(ctx, login)
+	require.NoError(t, err)
+	require.Len(t, withdrawals, 1)
+	require.Equal(t, withdrawal, withdrawals[0].Order)
+	require.Equal(t, model.Money(750), withdrawals[0].Sum)
+	require.NotNil(t, withdrawals[0].ProcessedAt)
+
+	withdrawals, err = storage.GetWithdrawals(ctx, newUser(t, storage))
+	require.NoError(t, err)
+	require.Empty(t, withdrawals)
+}
+
+func testWithdrawRetryDrained(t *testing.T, storage Repository) {
+	ctx := context.Background()
+	login := newUser(t, storage)
+	number := unique("order")
+
+	require.NoError(t, storage.UpdateOrder(ctx, login, model.Order{Number: number}))
+	require.NoError(t, storage.UpdateOrder(ctx, login, model.Order{Number: number, Status: model.OrderStatusProcessed, Accrual: money(1000)}))
+
+	withdrawal := unique("withdrawal")
+	require.NoError(t, storage.Withdraw(ctx, login, model.Withdraw{Order: withdrawal, Sum: 1000}))
+
+	// the account is empty now, a retry is still reported as a duplicate
+	err := storage.Withdraw(ctx, login, model.Withdraw{Order: withdrawal, Sum: 1000})
+	require.ErrorIs(t, err, model.ErrorWithdrawExists)
+
+	err = storage.Withdraw(ctx, login, model.Withdraw{Order: unique("withdrawal"), Sum: 1})
+	require.ErrorIs(t, err, model.ErrorInsufficientFunds)
+
+	bal, err := storage.GetBalance(ctx, login)
+	require.NoError(t, err)
+	require.Equal(t, model.Balance{Current: 0, Withdrawn: 1000}, bal)
+
+	withdrawals, err := storage.GetWithdrawals(ctx, login)
+	require.NoError(t, err)
+	require.Len(t, withdrawals, 1)
+}
+
+func testGetWithdrawals(t *testing.T, storage Repository) {
+	ctx := context.Background()
+	login := newUser(t, storage)
+	number := unique("order")
+
+	require.NoError(t, storage.UpdateOrder(ctx, login, model.Order{Number: number}))
+	require.NoError(t, storage.UpdateOrder(ctx, login, model.Order{Number: number, Status: model.OrderStatusProcessed, Accrual: money(1000)}))
+
+	orders := []string{unique("withdrawal-b"), unique("withdrawal-a"), unique("withdrawal-c")}
+	for i, order := range orders {
+		require.NoError(t, storage.Withdraw(ctx, login, model.Withdraw{Order: order, Sum: model.Money(i + 1)}))
+		time.Sleep(time.Millisecond)
+	}
+
+	withdrawals, err := storage.GetWithdrawals(ctx, login)
+	require.NoError(t, err)
+	require.Len(t, withdrawals, len(orders))
+
+	for i, w := range withdrawals {
+		require.Equal(t, orders[i], w.Order)
+		require.Equal(t, model.Money(i+1), w.Sum)
+		if i > 0 {
+			require.False(t, w.ProcessedAt.Before(*withdrawals[i-1].ProcessedAt))
+		}
+	}
+
+	bal, err := storage.GetBalance(ctx, login)
+	require.NoError(t, err)
+	require.Equal(t, model.Balance{Current: 994, Withdrawn: 6}, bal)
+}
+
+func testIdempotency(t *testing.T, storage Repository) {
+	ctx := context.Background()
+	login := newUser(t, storage)
+	key := unique("key")
+
+	_, found, err := storage.GetIdempotentResponse(ctx, login, key)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	resp := model.IdempotentResponse{
+		RequestHash: "hash",
+		StatusCode:  200,
+		ContentType: "application/json",
+		Body:        []byte(`{}`),
+	}
+	require.NoError(t, storage.SaveIdempotentResponse(ctx, login, key, resp, time.Hour))
+
+	// a live record is never overwritten
+	require.NoError(t, storage.SaveIdempotentResponse(ctx, login, key, model.IdempotentResponse{RequestHash: "other", StatusCode: 500}, time.Hour))
+
+	stored, found, err := storage.GetIdempotentResponse(ctx, login, key)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, resp, stored)
+
+	_, found, err = storage.GetIdempotentResponse(ctx, newUser(t, storage), key)
+	require.NoError(t, err)
+	require.False(t, found)
+}
+
+func testIdempotencyReservation(t *testing.T, storage Repository) {
+	ctx := context.Background()
+	login := newUser(t, storage)
+	key := unique("key")
+
+	_, reserved, err := storage.ReserveIdempotencyKey(ctx, login, key, "hash", time.Hour)
+	require.NoError(t, err)
+	require.True(t, reserved)
+
+	// the key is taken until the request holding it finishes
+	stored, reserved, err := storage.ReserveIdempotencyKey(ctx, login, key, "hash", time.Hour)
+	require.NoError(t, err)
+	require.False(t, reserved)
+	require.True(t, stored.Pending())
+	require.Equal(t, "hash", stored.RequestHash)
+
+	// a released key may be reserved again
+	require.NoError(t, storage.ReleaseIdempotencyKey(ctx, login, key))
+	_, reserved, err = storage.ReserveIdempotencyKey(ctx, login, key, "hash", time.Hour)
+	require.NoError(t, err)
+	require.True(t, reserved)
+
+	resp := model.IdempotentResponse{
+		RequestHash: "hash",
+		StatusCode:  200,
+		ContentType: "application/json",
+		Body:        []byte(`{}`),
+	}
+	require.NoError(t, storage.SaveIdempotentResponse(ctx, login, key, resp, time.Hour))
+
+	stored, reserved, err = storage.ReserveIdempotencyKey(ctx, login, key, "hash", time.Hour)
+	require.NoError(t, err)
+	require.False(t, reserved)
+	require.Equal(t, resp, stored)
+
+	// a completed response is never released
+	require.NoError(t, storage.ReleaseIdempotencyKey(ctx, login, key))
+	stored, found, err := storage.GetIdempotentResponse(ctx, login, key)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, resp, stored)
+
+	// an expired reservation is taken over
+	other := unique("key")
+	_, reserved, err = storage.ReserveIdempotencyKey(ctx, login, other, "hash", -time.Second)
+	require.NoError(t, err)
+	require.True(t, reserved)
+	_, reserved, err = storage.ReserveIdempotencyKey(ctx, login, other, "other", time.Hour)
+	require.NoError(t, err)
+	require.True(t, reserved)
+}
+
+func testRefreshTokens(t *testing.T, storage Repository) {
+	ctx := context.Background()
+	login := newUser(t, storage)
+	expiresAt := time.Now().Add(time.Hour)
+
+	first, second, third := unique("refresh"), unique("refresh"), unique("refresh")
+	require.NoError(t, storage.SaveRefreshToken(ctx, login, first, expiresAt))
+
+	rotated, err := storage.RotateRefreshToken(ctx, first, second, expiresAt)
+	require.NoError(t, err)
+	require.Equal(t, login, rotated)
+
+	// reusing a rotated token revokes the whole family
+	_, err = storage.RotateRefreshToken(ctx, first, third, expiresAt)
+	require.ErrorIs(t, err, model.ErrorRefreshTokenInvalid)
+
+	_, err = storage.RotateRefreshToken(ctx, second, third, expiresAt)
+	require.ErrorIs(t, err, model.ErrorRefreshTokenInvalid)
+
+	_, err = storage.RotateRefreshToken(ctx, unique("refresh"), third, expiresAt)
+	require.ErrorIs(t, err, model.ErrorRefreshTokenInvalid)
+
+	expired := unique("refresh")
+	require.NoError(t, storage.SaveRefreshToken(ctx, login, expired, time.Now().Add(-time.Minute)))
+	_, err = storage.RotateRefreshToken(ctx, expired, third, expiresAt)
+	require.ErrorIs(t, err, model.ErrorRefreshTokenInvalid)
+
+	revoked := unique("refresh")
+	require.NoError(t, storage.SaveRefreshToken(ctx, login, revoked, expiresAt))
+	require.NoError(t, storage.RevokeRefreshToken(ctx, login, revoked))
+	_, err = storage.RotateRefreshToken(ctx, revoked, third, expiresAt)
+	require.ErrorIs(t, err, model.ErrorRefreshTokenInvalid)
+}
+
+func testAccessTokens(t *testing.T, storage Repository) {
+	ctx := context.Background()
+	login := newUser(t, storage)
+	jti := unique("jti")
+	issuedAt := time.Now().Add(-time.Minute)
+
+	revoked, err := storage.IsAccessTokenRevoked(ctx, jti, login, issuedAt)
+	require.NoError(t, err)
+	require.False(t, revoked)
+
+	require.NoError(t, storage.RevokeAccessToken(ctx, jti, time.Now().Add(time.Hour)))
+	require.NoError(t, storage.RevokeAccessToken(ctx, jti, time.Now().Add(time.Hour)))
+
+	revoked, err = storage.IsAccessTokenRevoked(ctx, jti, login, issuedAt)
+	require.NoError(t, err)
+	require.True(t, revoked)
+
+	other := unique("jti")
+	require.NoError(t, storage.RevokeAllTokens(ctx, login))
+
+	revoked, err = storage.IsAccessTokenRevoked(ctx, other, login, issuedAt)
+	require.NoError(t, err)
+	require.True(t, revoked)
+
+	// tokens issued after the revocation stay valid
+	revoked, err = storage.IsAccessTokenRevoked(ctx, other, login, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.False(t, revoked)
+
+	// a login right after "log out all devices" gets a token whose iat is in the same second
+	require.NoError(t, storage.RevokeAllTokens(ctx, login))
+	revoked, err = storage.IsAccessTokenRevoked(ctx, unique("jti"), login, time.Now().Truncate(time.Second))
+	require.NoError(t, err)
+	require.False(t, revoked)
+}
@@ -0,0 +1,65 @@
+// Package testdb gives tests their own schema of the TEST_DATABASE_URI database,
+// tests that need Postgres are skipped when it isn't set.
+package testdb
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/stretchr/testify/require"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+const EnvDsn = "TEST_DATABASE_URI"
+
+// DSN creates a fresh empty schema, dropped when the test ends, and returns a dsn that points at it.
+func DSN(t *testing.T) string {
+	t.Helper()
+
+	dsn := os.Getenv(EnvDsn)
+	if dsn == "" {
+		t.Skipf("%s is not set", EnvDsn)
+	}
+
+	ctx := context.Background()
+	schema := fmt.Sprintf("gophermart_test_%d", time.Now().UnixNano())
+
+	admin, err := pgx.Connect(ctx, dsn)
+	require.NoError(t, err)
+
+	_, err = admin.Exec(ctx, "CREATE SCHEMA "+schema)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		_, err := admin.Exec(ctx, "DROP SCHEMA "+schema+" CASCADE")
+		if err != nil {
+			t.Log(err)
+		}
+		admin.Close(ctx)
+	})
+
+	u, err := url.Parse(dsn)
+	if err != nil || u.Scheme == "" {
+		return dsn + " search_path=" + schema
+	}
+
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// Pool connects to a fresh empty schema, see DSN.
+func Pool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+
+	pool, err := pgxpool.New(context.Background(), DSN(t))
+	require.NoError(t, err)
+	t.Cleanup(pool.Close)
+
+	return pool
+}
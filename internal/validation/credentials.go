@@ -0,0 +1,159 @@
+package validation
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/model"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	DefaultLoginPattern       = `^[A-Za-z0-9._@-]+$`
+	DefaultLoginMinLength     = 3
+	DefaultLoginMaxLength     = 100 // users.login is VARCHAR(100)
+	DefaultPasswordMinLength  = 8
+	DefaultPasswordMaxLength  = 256
+	DefaultPasswordMinClasses = 2
+)
+
+// Violation is a single broken rule, Rule is a stable machine readable code.
+type Violation struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// CredentialPolicy validates logins and passwords of new accounts.
+type CredentialPolicy struct {
+	LoginPattern       *regexp.Regexp
+	LoginMinLength     int
+	LoginMaxLength     int
+	PasswordMinLength  int
+	PasswordMaxLength  int
+	PasswordMinClasses int // of lower case, upper case, digits and other characters
+	Denylist           map[string]struct{}
+}
+
+func DefaultCredentialPolicy() CredentialPolicy {
+	return CredentialPolicy{
+		LoginPattern:       regexp.MustCompile(DefaultLoginPattern),
+		LoginMinLength:     DefaultLoginMinLength,
+		LoginMaxLength:     DefaultLoginMaxLength,
+		PasswordMinLength:  DefaultPasswordMinLength,
+		PasswordMaxLength:  DefaultPasswordMaxLength,
+		PasswordMinClasses: DefaultPasswordMinClasses,
+	}
+}
+
+func (p CredentialPolicy) Check() error {
+	if p.LoginMinLength < 1 || p.LoginMaxLength < p.LoginMinLength || p.LoginMaxLength > DefaultLoginMaxLength {
+		return fmt.Errorf("error: login length must be between 1 and %d", DefaultLoginMaxLength)
+	}
+
+	if p.PasswordMinLength < 1 || p.PasswordMaxLength < p.PasswordMinLength {
+		return errors.New("error: password min length must be positive and not exceed max length")
+	}
+
+	if p.PasswordMinClasses < 0 || p.PasswordMinClasses > 4 {
+		return errors.New("error: password min classes must be between 0 and 4")
+	}
+
+	return nil
+}
+
+// ValidateCredentials returns every rule the user's login and password break.
+func (p CredentialPolicy) ValidateCredentials(user model.User) []Violation {
+	var violations []Violation
+	add := func(field, rule, format string, args ...interface{}) {
+		violations = append(violations, Violation{Field: field, Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+
+	loginLen := utf8.RuneCountInString(user.Login)
+	switch {
+	case loginLen == 0:
+		add("login", "required", "login is required")
+	case loginLen < p.LoginMinLength:
+		add("login", "min_length", "login must be at least %d characters long", p.LoginMinLength)
+	case loginLen > p.LoginMaxLength:
+		add("login", "max_length", "login must be at most %d characters long", p.LoginMaxLength)
+	}
+
+	if loginLen > 0 && p.LoginPattern != nil && !p.LoginPattern.MatchString(user.Login) {
+		add("login", "charset", "login must match %s", p.LoginPattern.String())
+	}
+
+	passwordLen := utf8.RuneCountInString(user.Password)
+	switch {
+	case passwordLen == 0:
+		add("password", "required", "password is required")
+		return violations
+	case passwordLen < p.PasswordMinLength:
+		add("password", "min_length", "password must be at least %d characters long", p.PasswordMinLength)
+	case passwordLen > p.PasswordMaxLength:
+		add("password", "max_length", "password must be at most %d characters long", p.PasswordMaxLength)
+	}
+
+	if classes := characterClasses(user.Password); classes < p.PasswordMinClasses {
+		add("password", "strength", "password must mix at least %d of lower case, upper case, digits and other characters", p.PasswordMinClasses)
+	}
+
+	if user.Login != "" && strings.Contains(strings.ToLower(user.Password), strings.ToLower(user.Login)) {
+		add("password", "contains_login", "password must not contain the login")
+	}
+
+	if _, ok := p.Denylist[strings.ToLower(user.Password)]; ok {
+		add("password", "breached", "password is known to be breached")
+	}
+
+	return violations
+}
+
+func characterClasses(s string) int {
+	var lower, upper, digit, other int
+	for _, r := range s {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
+
+// LoadDenylist reads breached passwords from a file, one per line, matching is case-insensitive.
+// Empty lines and lines starting with # are skipped.
+func LoadDenylist(path string) (map[string]struct{}, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	denylist := make(map[string]struct{})
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		denylist[strings.ToLower(line)] = struct{}{}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return denylist, nil
+}
@@ -0,0 +1,95 @@
+package validation
+
+import (
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/model"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func rules(violations []Violation) []string {
+	var res []string
+	for _, v := range violations {
+		res = append(res, v.Field+":"+v.Rule)
+	}
+	return res
+}
+
+func TestCredentialPolicy_ValidateCredentials(t *testing.T) {
+	policy := DefaultCredentialPolicy()
+	policy.Denylist = map[string]struct{}{"password1": {}}
+
+	tests := []struct {
+		name string
+		user model.User
+		want []string
+	}{
+		{
+			name: "valid",
+			user: model.User{Login: "gopher", Password: "Tr0ub4dor&3"},
+		},
+		{
+			name: "empty",
+			user: model.User{},
+			want: []string{"login:required", "password:required"},
+		},
+		{
+			name: "short_login_bad_charset",
+			user: model.User{Login: "a!", Password: "Tr0ub4dor&3"},
+			want: []string{"login:min_length", "login:charset"},
+		},
+		{
+			name: "long_login",
+			user: model.User{Login: strings.Repeat("a", 101), Password: "Tr0ub4dor&3"},
+			want: []string{"login:max_length"},
+		},
+		{
+			name: "short_password",
+			user: model.User{Login: "gopher", Password: "Ab1"},
+			want: []string{"password:min_length"},
+		},
+		{
+			name: "weak_password",
+			user: model.User{Login: "gopher", Password: "abcdefghij"},
+			want: []string{"password:strength"},
+		},
+		{
+			name: "password_contains_login",
+			user: model.User{Login: "gopher", Password: "MyGopher42"},
+			want: []string{"password:contains_login"},
+		},
+		{
+			name: "breached_password",
+			user: model.User{Login: "gopher", Password: "Password1"},
+			want: []string{"password:breached"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, rules(policy.ValidateCredentials(tt.user)))
+		})
+	}
+}
+
+func TestCredentialPolicy_Check(t *testing.T) {
+	require.NoError(t, DefaultCredentialPolicy().Check())
+
+	policy := DefaultCredentialPolicy()
+	policy.LoginMaxLength = 200
+	require.Error(t, policy.Check())
+
+	policy = DefaultCredentialPolicy()
+	policy.PasswordMinClasses = 5
+	require.Error(t, policy.Check())
+}
+
+func TestLoadDenylist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "denylist.txt")
+	require.NoError(t, os.WriteFile(path, []byte("# top passwords\nPassword1\n\nqwerty123\n"), 0o600))
+
+	denylist, err := LoadDenylist(path)
+	require.NoError(t, err)
+	require.Equal(t, map[string]struct{}{"password1": {}, "qwerty123": {}}, denylist)
+}
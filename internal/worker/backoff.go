@@ -0,0 +1,46 @@
+package worker
+
+import (
+	"errors"
+	"time"
+)
+
+// BackoffPolicy spaces out the polls of an order that stays NEW or PROCESSING,
+// the delay doubles with every poll since the last status change up to Max.
+type BackoffPolicy struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+var DefaultBackoff = BackoffPolicy{
+	Base: time.Second,
+	Max:  10 * time.Minute,
+}
+
+func (p BackoffPolicy) Check() error {
+	if p.Base <= 0 || p.Max <= 0 {
+		return errors.New("accrual backoff must be positive")
+	}
+
+	if p.Base > p.Max {
+		return errors.New("accrual backoff base exceeds its max")
+	}
+
+	return nil
+}
+
+// delay returns the pause before the next poll, jitter is a random value in [0, 1)
+// that spreads the second half of the delay, so orders uploaded together don't stay in lockstep.
+func (p BackoffPolicy) delay(attempts int, jitter float64) time.Duration {
+	d := p.Max
+	if attempts <= 1 {
+		d = p.Base
+	} else if attempts <= 32 {
+		if shifted := p.Base << (attempts - 1); shifted > 0 && shifted < p.Max {
+			d = shifted
+		}
+	}
+
+	half := d / 2
+	return half + time.Duration(jitter*float64(d-half))
+}
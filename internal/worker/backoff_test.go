@@ -0,0 +1,58 @@
+package worker
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestBackoffPolicy_Delay(t *testing.T) {
+	policy := BackoffPolicy{Base: time.Second, Max: time.Minute}
+
+	tests := []struct {
+		name     string
+		attempts int
+		jitter   float64
+		want     time.Duration
+	}{
+		{
+			name:     "first_poll",
+			attempts: 1,
+			want:     500 * time.Millisecond,
+		},
+		{
+			name:     "first_poll_max_jitter",
+			attempts: 1,
+			jitter:   0.999,
+			want:     999500 * time.Microsecond,
+		},
+		{
+			name:     "doubles",
+			attempts: 4,
+			jitter:   0.5,
+			want:     6 * time.Second,
+		},
+		{
+			name:     "capped",
+			attempts: 7,
+			want:     30 * time.Second,
+		},
+		{
+			name:     "overflow",
+			attempts: 1000,
+			jitter:   0.5,
+			want:     45 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, policy.delay(tt.attempts, tt.jitter))
+		})
+	}
+}
+
+func TestBackoffPolicy_Check(t *testing.T) {
+	require.NoError(t, DefaultBackoff.Check())
+	require.Error(t, BackoffPolicy{Base: time.Minute, Max: time.Second}.Check())
+	require.Error(t, BackoffPolicy{Max: time.Second}.Check())
+}
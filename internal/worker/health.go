@@ -0,0 +1,74 @@
+package worker
+
+import (
+	"sync"
+	"time"
+)
+
+// Health describes whether the pool is able to pick up jobs. It is served publicly, so it carries
+// no error text, which may name the database host or user; failures are logged in full.
+type Health struct {
+	Healthy             bool          `json:"healthy"`
+	LastLeaseAt         time.Time     `json:"last_lease_at,omitempty"`
+	LastErrorAt         time.Time     `json:"last_error_at,omitempty"`
+	ConsecutiveFailures int           `json:"consecutive_failures,omitempty"`
+	RetryAt             time.Time     `json:"retry_at,omitempty"`
+	InFlight            int64         `json:"in_flight"`
+	Throttle            ThrottleState `json:"throttle"`
+}
+
+// scheduler tracks the outcome of the lease attempts of the request worker.
+// Failed leases are retried with the backoff instead of on every tick.
+type scheduler struct {
+	backoff BackoffPolicy
+
+	mu          sync.Mutex
+	lastLeaseAt time.Time
+	lastErrorAt time.Time
+	failures    int
+	retryAt     time.Time
+}
+
+// succeed records a lease, an empty one included, and returns how many failures preceded it.
+func (s *scheduler) succeed(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	failures := s.failures
+	s.lastLeaseAt = now
+	s.failures = 0
+	s.retryAt = time.Time{}
+	return failures
+}
+
+// fail records a failed lease and returns when to try again.
+func (s *scheduler) fail(now time.Time, jitter float64) (time.Time, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures++
+	s.lastErrorAt = now
+	s.retryAt = now.Add(s.backoff.delay(s.failures, jitter))
+	return s.retryAt, s.failures
+}
+
+// due reports whether the backoff after failed leases is over.
+func (s *scheduler) due(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return !now.Before(s.retryAt)
+}
+
+func (s *scheduler) health() Health {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return Health{
+		Healthy:             s.failures == 0,
+		LastLeaseAt:         s.lastLeaseAt,
+		LastErrorAt:         s.lastErrorAt,
+		ConsecutiveFailures: s.failures,
+		RetryAt:             s.retryAt,
+	}
+}
@@ -0,0 +1,91 @@
+package worker
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ThrottleState describes the pool-wide backoff imposed by the accrual system.
+type ThrottleState struct {
+	Paused            bool      `json:"paused"`
+	PausedUntil       time.Time `json:"paused_until,omitempty"`
+	RequestsPerMinute int       `json:"requests_per_minute,omitempty"`
+}
+
+// throttle is shared by all update workers so that a single 429 pauses the whole pool.
+type throttle struct {
+	mu          sync.Mutex
+	pausedUntil time.Time
+	limit       int
+	interval    time.Duration
+	next        time.Time
+}
+
+// wait blocks until the pool may send the next request, or until ctx is done.
+func (t *throttle) wait(ctx context.Context) error {
+	for {
+		t.mu.Lock()
+		now := time.Now()
+
+		wake := t.pausedUntil
+		if t.interval > 0 && t.next.After(wake) {
+			wake = t.next
+		}
+
+		if !wake.After(now) {
+			if t.interval > 0 {
+				t.next = now.Add(t.interval)
+			}
+			t.mu.Unlock()
+			return nil
+		}
+		t.mu.Unlock()
+
+		timer := time.NewTimer(wake.Sub(now))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+func (t *throttle) pause(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	until := time.Now().Add(d)
+	if until.After(t.pausedUntil) {
+		t.pausedUntil = until
+	}
+}
+
+func (t *throttle) setLimit(requestsPerMinute int) {
+	if requestsPerMinute <= 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.limit = requestsPerMinute
+	t.interval = time.Minute / time.Duration(requestsPerMinute)
+}
+
+func (t *throttle) state() ThrottleState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state := ThrottleState{
+		RequestsPerMinute: t.limit,
+	}
+
+	if t.pausedUntil.After(time.Now()) {
+		state.Paused = true
+		state.PausedUntil = t.pausedUntil
+	}
+
+	return state
+}
@@ -0,0 +1,34 @@
+package worker
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	th := &throttle{}
+	require.False(t, th.state().Paused)
+
+	th.setLimit(600)
+	th.pause(50 * time.Millisecond)
+
+	state := th.state()
+	require.True(t, state.Paused)
+	require.Equal(t, 600, state.RequestsPerMinute)
+
+	start := time.Now()
+	require.NoError(t, th.wait(context.Background()))
+	require.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+	require.False(t, th.state().Paused)
+
+	start = time.Now()
+	require.NoError(t, th.wait(context.Background()))
+	require.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+
+	th.pause(time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, th.wait(ctx), context.DeadlineExceeded)
+}
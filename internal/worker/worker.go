@@ -1,41 +1,131 @@
 package worker
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/accrual"
 	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/model"
-	"io"
 	"log"
-	"net/http"
+	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+type accrualClient interface {
+	GetOrder(ctx context.Context, number string) (accrual.OrderAccrual, error)
+}
+
 type repository interface {
-	UpdateOrder(login string, order model.Order) error
-	GetOrderOwner(orderNum string) (login string, err error)
-	GetProcessingOrders() ([]model.Order, error)
+	UpdateOrder(ctx context.Context, login string, order model.Order) error
+	GetOrderOwner(ctx context.Context, orderNum string) (login string, err error)
+	LeaseAccrualJobs(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]model.AccrualJob, error)
+	RescheduleAccrualJob(ctx context.Context, number string, nextPollAt time.Time) error
+}
+
+const (
+	storageTimeout = 5 * time.Second
+
+	// leaseDuration bounds how long a job stays with a worker that died mid-poll, before another instance retries it.
+	leaseDuration = time.Minute
+
+	// retryMaxDelay caps the pause between failed leases.
+	retryMaxDelay = time.Minute
+
+	DefaultSize         = 8
+	DefaultBatchSize    = 50
+	DefaultMaxInFlight  = 100
+	DefaultPollInterval = 2 * time.Second
+
+	// DefaultGiveUpAfter is how long an order may stay unknown to the accrual system before it's marked INVALID.
+	DefaultGiveUpAfter = 24 * time.Hour
+)
+
+// Config tunes the pool.
+type Config struct {
+	Size         int // concurrent accrual requests
+	BatchSize    int // due jobs leased per tick
+	MaxInFlight  int // leased jobs not polled yet, no more are leased above it
+	PollInterval time.Duration
+	GiveUpAfter  time.Duration
+	Backoff      BackoffPolicy
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Size:         DefaultSize,
+		BatchSize:    DefaultBatchSize,
+		MaxInFlight:  DefaultMaxInFlight,
+		PollInterval: DefaultPollInterval,
+		GiveUpAfter:  DefaultGiveUpAfter,
+		Backoff:      DefaultBackoff,
+	}
 }
 
-const updateInterval = 2 * time.Second
+func (c Config) Check() error {
+	if c.Size <= 0 || c.BatchSize <= 0 || c.MaxInFlight <= 0 {
+		return errors.New("worker pool size, batch size and max in-flight jobs must be positive")
+	}
+
+	if c.PollInterval <= 0 {
+		return errors.New("accrual poll interval must be positive")
+	}
+
+	if c.GiveUpAfter <= 0 {
+		return errors.New("accrual give up period must be positive")
+	}
+
+	return c.Backoff.Check()
+}
 
 type workerPool struct {
+	// ctx bounds the accrual requests in flight, stopCtx is done once no new polls may start.
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopCtx context.Context
+	stop    context.CancelFunc
+	wg      sync.WaitGroup
+
 	size         int
-	addr         string
-	orderC       chan model.Order
+	batchSize    int
+	maxInFlight  int64
+	inFlight     atomic.Int64
+	accrual      accrualClient
+	jobC         chan model.AccrualJob
 	storage      repository
 	updateTicker *time.Ticker
+	throttle     *throttle
+	scheduler    *scheduler
+	giveUpAfter  time.Duration
+	backoff      BackoffPolicy
+	now          func() time.Time
+	jitter       func() float64
 }
 
-func NewWorkerPool(workersCnt int, address string, storage repository) *workerPool {
+func NewWorkerPool(config Config, client accrualClient, storage repository) *workerPool {
 	return &workerPool{
-		size:         workersCnt,
-		addr:         address,
-		orderC:       make(chan model.Order),
+		size:         config.Size,
+		batchSize:    config.BatchSize,
+		maxInFlight:  int64(config.MaxInFlight),
+		accrual:      client,
+		jobC:         make(chan model.AccrualJob),
 		storage:      storage,
-		updateTicker: time.NewTicker(updateInterval),
+		updateTicker: time.NewTicker(config.PollInterval),
+		throttle:     &throttle{},
+		scheduler:    &scheduler{backoff: BackoffPolicy{Base: config.PollInterval, Max: retryMaxDelay}},
+		giveUpAfter:  config.GiveUpAfter,
+		backoff:      config.Backoff,
+		now:          time.Now,
+		jitter:       rand.Float64,
 	}
 }
 
-func (wp *workerPool) Run() {
+// Run starts the workers, cancelling ctx aborts the accrual requests in flight.
+func (wp *workerPool) Run(ctx context.Context) {
+	wp.ctx, wp.cancel = context.WithCancel(ctx)
+	wp.stopCtx, wp.stop = context.WithCancel(wp.ctx)
+
 	for i := 0; i < wp.size; i++ {
 		wp.newUpdateWorker()
 	}
@@ -43,76 +133,246 @@ func (wp *workerPool) Run() {
 	wp.newRequestWorker()
 }
 
+// Shutdown stops leasing jobs and waits for the polls in flight. When ctx is done first,
+// the outstanding accrual requests are cancelled and their jobs are left to the lease expiry.
+func (wp *workerPool) Shutdown(ctx context.Context) error {
+	wp.stop()
+
+	done := make(chan struct{})
+	go func() {
+		wp.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		wp.cancel()
+		return nil
+	case <-ctx.Done():
+		wp.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
 func (wp *workerPool) newUpdateWorker() {
+	wp.wg.Add(1)
 	go func() {
-		for order := range wp.orderC {
-			resp, err := http.Get(wp.addr + order.Number)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
+		defer wp.wg.Done()
 
-			if resp.StatusCode != http.StatusOK {
-				log.Printf("Error: got status code: %d", resp.StatusCode)
+		for job := range wp.jobC {
+			if err := wp.throttle.wait(wp.stopCtx); err != nil {
+				wp.release(job)
 				continue
 			}
+			wp.process(wp.ctx, job)
+		}
+	}()
+}
 
-			bytes, err := io.ReadAll(resp.Body)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
+func (wp *workerPool) process(ctx context.Context, job model.AccrualJob) {
+	defer wp.inFlight.Add(-1)
+
+	status, err := wp.updateOrder(ctx, job.Order)
+	if err != nil {
+		log.Println(err)
+	}
+
+	// the backoff starts over once the order moves on
+	attempts := job.Attempts
+	if status != job.Order.Status {
+		attempts = 1
+	}
+
+	wp.reschedule(job.Order.Number, attempts)
+}
+
+// updateOrder polls the accrual system and returns the status the order has afterwards.
+func (wp *workerPool) updateOrder(ctx context.Context, order model.Order) (string, error) {
+	resp, err := wp.accrual.GetOrder(ctx, order.Number)
+
+	var tooMany *accrual.TooManyRequestsError
+	if errors.As(err, &tooMany) {
+		wp.handleTooManyRequests(tooMany)
+		return order.Status, nil
+	}
+
+	if errors.Is(err, accrual.ErrorOrderNotRegistered) {
+		return wp.handleNotRegistered(order)
+	}
+
+	if err != nil {
+		return order.Status, err
+	}
+
+	update := model.Order{
+		Number:  order.Number,
+		Status:  resp.Status,
+		Accrual: resp.Accrual,
+	}
+
+	if update.Status == accrual.StatusRegistered {
+		update.Status = model.OrderStatusNew
+	}
+
+	err = wp.saveOrder(update)
+	if err != nil {
+		return order.Status, err
+	}
+
+	return update.Status, nil
+}
+
+// handleNotRegistered keeps polling an order the accrual system doesn't know yet,
+// until it has been unknown for longer than giveUpAfter.
+func (wp *workerPool) handleNotRegistered(order model.Order) (string, error) {
+	if order.UploadedAt.IsZero() || wp.now().Sub(order.UploadedAt) < wp.giveUpAfter {
+		return order.Status, nil
+	}
+
+	log.Printf("Order %s isn't registered in the accrual system since %s, marking it invalid", order.Number, order.UploadedAt.Format(time.RFC3339))
+	err := wp.saveOrder(model.Order{
+		Number: order.Number,
+		Status: model.OrderStatusInvalid,
+	})
+	if err != nil {
+		return order.Status, err
+	}
+
+	return model.OrderStatusInvalid, nil
+}
+
+// reschedule releases the job for the next poll, after the pool-wide pause if there is one.
+func (wp *workerPool) reschedule(number string, attempts int) {
+	next := wp.now().Add(wp.backoff.delay(attempts, wp.jitter()))
+	if state := wp.throttle.state(); state.PausedUntil.After(next) {
+		next = state.PausedUntil
+	}
+
+	wp.setNextPoll(number, next)
+}
+
+// release gives back a job that wasn't polled, so another instance may take it right away.
+func (wp *workerPool) release(job model.AccrualJob) {
+	defer wp.inFlight.Add(-1)
+
+	wp.setNextPoll(job.Order.Number, wp.now())
+}
+
+func (wp *workerPool) setNextPoll(number string, next time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), storageTimeout)
+	defer cancel()
+
+	err := wp.storage.RescheduleAccrualJob(ctx, number, next)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (wp *workerPool) saveOrder(order model.Order) error {
+	ctx, cancel := context.WithTimeout(context.Background(), storageTimeout)
+	defer cancel()
+
+	login, err := wp.storage.GetOrderOwner(ctx, order.Number)
+	if err != nil {
+		return err
+	}
+
+	err = wp.storage.UpdateOrder(ctx, login, order)
+	if errors.Is(err, model.ErrorOrderTransition) {
+		return fmt.Errorf("rejected accrual update of order %s: %w", order.Number, err)
+	}
+	return err
+}
+
+func (wp *workerPool) handleTooManyRequests(err *accrual.TooManyRequestsError) {
+	wp.throttle.setLimit(err.RequestsPerMinute)
+	wp.throttle.pause(err.RetryAfter)
+
+	log.Printf("Accrual system is throttling requests, pausing workers for %s: %+v", err.RetryAfter, wp.throttle.state())
+}
+
+func (wp *workerPool) ThrottleState() ThrottleState {
+	return wp.throttle.state()
+}
 
-			err = resp.Body.Close()
-			if err != nil {
-				log.Println(err)
+// Health reports whether jobs are being leased, the pool is unhealthy while the storage keeps failing.
+func (wp *workerPool) Health() Health {
+	h := wp.scheduler.health()
+	h.Throttle = wp.throttle.state()
+	h.InFlight = wp.inFlight.Load()
+	return h
+}
+
+// newRequestWorker leases a batch of due jobs on every tick and hands them to the update workers,
+// it does nothing while the accrual system is throttling the pool. Failed leases are retried
+// with a backoff instead of on every tick. It's the only sender on jobC and closes it on shutdown,
+// releasing the jobs it couldn't hand out.
+func (wp *workerPool) newRequestWorker() {
+	wp.wg.Add(1)
+	go func() {
+		defer wp.wg.Done()
+		defer close(wp.jobC)
+		defer wp.updateTicker.Stop()
+
+		for {
+			select {
+			case <-wp.stopCtx.Done():
+				return
+			case <-wp.updateTicker.C:
 			}
 
-			err = json.Unmarshal(bytes, &order)
-			if err != nil {
-				log.Println(err)
+			if wp.throttle.state().Paused || !wp.scheduler.due(wp.now()) {
 				continue
 			}
 
-			if order.Status == model.OrderStatusRegistered {
-				order.Status = model.OrderStatusNew
+			limit := wp.maxInFlight - wp.inFlight.Load()
+			if limit <= 0 {
+				continue
+			}
+			if limit > int64(wp.batchSize) {
+				limit = int64(wp.batchSize)
 			}
 
-			login, err := wp.storage.GetOrderOwner(order.Number)
-			if err != nil {
-				log.Println(err)
+			jobs, ok := wp.lease(limit)
+			if !ok {
 				continue
 			}
 
-			err = wp.storage.UpdateOrder(login, order)
-			if err != nil {
-				log.Println(err)
-				continue
+			for i, job := range jobs {
+				select {
+				case wp.jobC <- job:
+				case <-wp.stopCtx.Done():
+					for _, job := range jobs[i:] {
+						wp.release(job)
+					}
+					return
+				}
 			}
 		}
 	}()
 }
 
-func (wp *workerPool) newRequestWorker() {
-	go func() {
-		for range wp.updateTicker.C {
-			orders, err := wp.storage.GetProcessingOrders()
-			if err != nil {
-				log.Println(err)
-				break
-			}
-			for _, order := range orders {
-				wp.AddOrder(order)
-			}
+// lease takes a batch of due jobs, no due jobs isn't a failure.
+func (wp *workerPool) lease(limit int64) ([]model.AccrualJob, bool) {
+	ctx, cancel := context.WithTimeout(wp.stopCtx, storageTimeout)
+	defer cancel()
+
+	jobs, err := wp.storage.LeaseAccrualJobs(ctx, wp.now(), int(limit), leaseDuration)
+	if err != nil {
+		if wp.stopCtx.Err() != nil {
+			return nil, false
 		}
-	}()
-}
 
-func (wp *workerPool) AddOrder(order model.Order) {
-	wp.orderC <- order
-}
+		retryAt, failures := wp.scheduler.fail(wp.now(), wp.jitter())
+		log.Printf("Failed to lease accrual jobs %d times in a row, retrying at %s: %v", failures, retryAt.Format(time.RFC3339), err)
+		return nil, false
+	}
+
+	if failures := wp.scheduler.succeed(wp.now()); failures > 0 {
+		log.Printf("Leasing accrual jobs recovered after %d failures", failures)
+	}
 
-func (wp *workerPool) Stop() {
-	wp.updateTicker.Stop()
-	close(wp.orderC)
+	wp.inFlight.Add(int64(len(jobs)))
+	return jobs, true
 }
@@ -0,0 +1,471 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/accrual"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/accrual/stub"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/model"
+	"github.com/VladimirMovsesyan/praktikum-gophermart/internal/repository/memory"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+func TestWorkerPool_Accrual(t *testing.T) {
+	accrualStub := stub.NewServer()
+	srv := httptest.NewServer(accrualStub.Handler())
+	defer srv.Close()
+
+	ctx := context.Background()
+	storage := memory.NewStorage()
+	require.NoError(t, storage.Create(ctx, model.User{Login: "gopher", Password: "hash"}))
+
+	accrualStub.Script("79927398713", stub.Registered(), stub.Processing(), stub.Processed(50050))
+	require.NoError(t, storage.UpdateOrder(ctx, "gopher", model.Order{Number: "79927398713"}))
+
+	client, err := accrual.NewClient(srv.URL, "", srv.Client(), time.Second, nil)
+	require.NoError(t, err)
+
+	config := DefaultConfig()
+	config.Size = 2
+	config.Backoff = BackoffPolicy{Base: time.Millisecond, Max: 5 * time.Millisecond}
+
+	wp := NewWorkerPool(config, client, storage)
+	wp.updateTicker.Reset(10 * time.Millisecond)
+	wp.Run(context.Background())
+	defer func() { require.NoError(t, wp.Shutdown(context.Background())) }()
+
+	status := func() string {
+		orders, err := storage.GetOrders(ctx, "gopher")
+		require.NoError(t, err)
+		return orders[0].Status
+	}
+
+	require.Eventually(t, func() bool { return status() == model.OrderStatusProcessed }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, 3, accrualStub.Requests("79927398713"))
+
+	// the job is done, the order isn't polled anymore
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 3, accrualStub.Requests("79927398713"))
+
+	bal, err := storage.GetBalance(ctx, "gopher")
+	require.NoError(t, err)
+	require.Equal(t, model.Money(50050), bal.Current)
+}
+
+func TestWorkerPool_UpdateOrder(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		script     []stub.Response
+		uploadedAt time.Time
+		status     string
+		want       string
+		wantErr    error
+	}{
+		{
+			name:   "invalid",
+			script: []stub.Response{stub.Invalid()},
+			want:   model.OrderStatusInvalid,
+		},
+		{
+			name:       "not_registered_yet",
+			script:     []stub.Response{stub.NotRegistered()},
+			uploadedAt: now.Add(-time.Hour),
+			want:       model.OrderStatusNew,
+		},
+		{
+			name:       "never_registered",
+			script:     []stub.Response{stub.NotRegistered()},
+			uploadedAt: now.Add(-DefaultGiveUpAfter),
+			want:       model.OrderStatusInvalid,
+		},
+		{
+			name:    "illegal_transition",
+			script:  []stub.Response{stub.Registered()},
+			status:  model.OrderStatusProcessing,
+			want:    model.OrderStatusProcessing,
+			wantErr: model.ErrorOrderTransition,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accrualStub := stub.NewServer()
+			srv := httptest.NewServer(accrualStub.Handler())
+			defer srv.Close()
+
+			ctx := context.Background()
+			storage := memory.NewStorage()
+			require.NoError(t, storage.Create(ctx, model.User{Login: "gopher", Password: "hash"}))
+			require.NoError(t, storage.UpdateOrder(ctx, "gopher", model.Order{Number: "79927398713"}))
+			current := model.OrderStatusNew
+			if tt.status != "" {
+				require.NoError(t, storage.UpdateOrder(ctx, "gopher", model.Order{Number: "79927398713", Status: tt.status}))
+				current = tt.status
+			}
+			accrualStub.Script("79927398713", tt.script...)
+
+			client, err := accrual.NewClient(srv.URL, "", srv.Client(), time.Second, nil)
+			require.NoError(t, err)
+
+			wp := NewWorkerPool(DefaultConfig(), client, storage)
+			defer wp.updateTicker.Stop()
+			wp.now = func() time.Time { return now }
+
+			status, err := wp.updateOrder(ctx, model.Order{Number: "79927398713", Status: current, UploadedAt: tt.uploadedAt})
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.want, status)
+
+			orders, err := storage.GetOrders(ctx, "gopher")
+			require.NoError(t, err)
+			require.Equal(t, tt.want, orders[0].Status)
+		})
+	}
+}
+
+type rescheduleRepository struct {
+	repository
+
+	nextPollAt map[string]time.Time
+}
+
+func (r *rescheduleRepository) GetOrderOwner(context.Context, string) (string, error) {
+	return "gopher", nil
+}
+
+func (r *rescheduleRepository) UpdateOrder(context.Context, string, model.Order) error {
+	return nil
+}
+
+func (r *rescheduleRepository) RescheduleAccrualJob(_ context.Context, number string, nextPollAt time.Time) error {
+	r.nextPollAt[number] = nextPollAt
+	return nil
+}
+
+func TestWorkerPool_Reschedule(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		script []stub.Response
+		job    model.AccrualJob
+		want   time.Duration
+		paused bool // the pause is measured by the wall clock
+	}{
+		{
+			name:   "first_poll",
+			script: []stub.Response{stub.Registered()},
+			job:    model.AccrualJob{Order: model.Order{Status: model.OrderStatusNew}, Attempts: 1},
+			want:   time.Second,
+		},
+		{
+			name:   "still_processing",
+			script: []stub.Response{stub.Processing()},
+			job:    model.AccrualJob{Order: model.Order{Status: model.OrderStatusProcessing}, Attempts: 4},
+			want:   8 * time.Second,
+		},
+		{
+			name:   "moved_on",
+			script: []stub.Response{stub.Processing()},
+			job:    model.AccrualJob{Order: model.Order{Status: model.OrderStatusNew}, Attempts: 4},
+			want:   time.Second,
+		},
+		{
+			name:   "accrual_down",
+			script: []stub.Response{stub.Failure(http.StatusServiceUnavailable)},
+			job:    model.AccrualJob{Order: model.Order{Status: model.OrderStatusNew}, Attempts: 20},
+			want:   time.Minute,
+		},
+		{
+			name:   "throttled",
+			script: []stub.Response{stub.TooManyRequests(5 * time.Minute)},
+			job:    model.AccrualJob{Order: model.Order{Status: model.OrderStatusNew}, Attempts: 1},
+			want:   5 * time.Minute,
+			paused: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accrualStub := stub.NewServer()
+			srv := httptest.NewServer(accrualStub.Handler())
+			defer srv.Close()
+
+			tt.job.Order.Number = "79927398713"
+			accrualStub.Script(tt.job.Order.Number, tt.script...)
+
+			client, err := accrual.NewClient(srv.URL, "", srv.Client(), time.Second, nil)
+			require.NoError(t, err)
+
+			storage := &rescheduleRepository{nextPollAt: make(map[string]time.Time)}
+			config := DefaultConfig()
+			config.Backoff = BackoffPolicy{Base: time.Second, Max: time.Minute}
+
+			wp := NewWorkerPool(config, client, storage)
+			defer wp.updateTicker.Stop()
+			wp.now = func() time.Time { return now }
+			wp.jitter = func() float64 { return 0.999999 }
+
+			wp.process(context.Background(), tt.job)
+
+			got := storage.nextPollAt[tt.job.Order.Number]
+			if tt.paused {
+				require.WithinDuration(t, time.Now().Add(tt.want), got, time.Second)
+				return
+			}
+			require.WithinDuration(t, now.Add(tt.want), got, time.Millisecond)
+		})
+	}
+}
+
+func newShutdownPool(t *testing.T, latency time.Duration) (*workerPool, *stub.Server, *memory.Storage) {
+	t.Helper()
+
+	accrualStub := stub.NewServer()
+	accrualStub.SetLatency(latency)
+	accrualStub.Default(stub.Processed(100))
+
+	srv := httptest.NewServer(accrualStub.Handler())
+	t.Cleanup(srv.Close)
+
+	ctx := context.Background()
+	storage := memory.NewStorage()
+	require.NoError(t, storage.Create(ctx, model.User{Login: "gopher", Password: "hash"}))
+	require.NoError(t, storage.UpdateOrder(ctx, "gopher", model.Order{Number: "79927398713"}))
+
+	client, err := accrual.NewClient(srv.URL, "", srv.Client(), time.Minute, nil)
+	require.NoError(t, err)
+
+	wp := NewWorkerPool(DefaultConfig(), client, storage)
+	wp.updateTicker.Reset(10 * time.Millisecond)
+	wp.Run(ctx)
+
+	require.Eventually(t, func() bool { return accrualStub.Requests("79927398713") == 1 }, 5*time.Second, time.Millisecond)
+	return wp, accrualStub, storage
+}
+
+func TestWorkerPool_ShutdownDrains(t *testing.T) {
+	wp, _, storage := newShutdownPool(t, 100*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, wp.Shutdown(ctx))
+
+	// the poll in flight was completed
+	orders, err := storage.GetOrders(context.Background(), "gopher")
+	require.NoError(t, err)
+	require.Equal(t, model.OrderStatusProcessed, orders[0].Status)
+}
+
+func TestWorkerPool_ShutdownDeadline(t *testing.T) {
+	wp, _, storage := newShutdownPool(t, time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	require.ErrorIs(t, wp.Shutdown(ctx), context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	// the poll was cancelled, the order waits for the next one
+	orders, err := storage.GetOrders(context.Background(), "gopher")
+	require.NoError(t, err)
+	require.Equal(t, model.OrderStatusNew, orders[0].Status)
+}
+
+// flakyRepository fails to lease jobs a number of times before handing over to the storage.
+type flakyRepository struct {
+	*memory.Storage
+
+	mu       sync.Mutex
+	failures int
+	leases   int
+}
+
+func (r *flakyRepository) LeaseAccrualJobs(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]model.AccrualJob, error) {
+	r.mu.Lock()
+	r.leases++
+	fail := r.failures > 0
+	if fail {
+		r.failures--
+	}
+	r.mu.Unlock()
+
+	if fail {
+		return nil, errors.New("error: connection refused")
+	}
+	return r.Storage.LeaseAccrualJobs(ctx, now, limit, lease)
+}
+
+func (r *flakyRepository) fail(times int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.failures = times
+}
+
+func (r *flakyRepository) calls() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.leases
+}
+
+func TestWorkerPool_SchedulerResumes(t *testing.T) {
+	accrualStub := stub.NewServer()
+	accrualStub.Default(stub.Processed(100))
+
+	srv := httptest.NewServer(accrualStub.Handler())
+	defer srv.Close()
+
+	ctx := context.Background()
+	storage := &flakyRepository{Storage: memory.NewStorage()}
+	require.NoError(t, storage.Create(ctx, model.User{Login: "gopher", Password: "hash"}))
+
+	client, err := accrual.NewClient(srv.URL, "", srv.Client(), time.Second, nil)
+	require.NoError(t, err)
+
+	wp := NewWorkerPool(DefaultConfig(), client, storage)
+	wp.updateTicker.Reset(5 * time.Millisecond)
+	wp.scheduler.backoff = BackoffPolicy{Base: 10 * time.Millisecond, Max: 20 * time.Millisecond}
+	wp.Run(ctx)
+	defer func() { require.NoError(t, wp.Shutdown(context.Background())) }()
+
+	processed := func(number string) func() bool {
+		return func() bool {
+			orders, err := storage.GetOrders(ctx, "gopher")
+			require.NoError(t, err)
+			for _, order := range orders {
+				if order.Number == number {
+					return order.Status == model.OrderStatusProcessed
+				}
+			}
+			return false
+		}
+	}
+
+	// nothing to do isn't a failure, polling goes on
+	calls := storage.calls()
+	require.Eventually(t, func() bool { return storage.calls() >= calls+3 }, 5*time.Second, time.Millisecond)
+	require.True(t, wp.Health().Healthy)
+	require.False(t, wp.Health().LastLeaseAt.IsZero())
+
+	require.NoError(t, storage.UpdateOrder(ctx, "gopher", model.Order{Number: "79927398713"}))
+	require.Eventually(t, processed("79927398713"), 5*time.Second, time.Millisecond)
+
+	// the storage is down for a while, the scheduler reports it and keeps retrying
+	storage.fail(3)
+	require.Eventually(t, func() bool { return !wp.Health().Healthy }, 5*time.Second, time.Millisecond)
+
+	health := wp.Health()
+	require.False(t, health.LastErrorAt.IsZero())
+	require.False(t, health.RetryAt.IsZero())
+
+	require.NoError(t, storage.UpdateOrder(ctx, "gopher", model.Order{Number: "12345678903"}))
+	require.Eventually(t, processed("12345678903"), 5*time.Second, time.Millisecond)
+
+	health = wp.Health()
+	require.True(t, health.Healthy)
+	require.Zero(t, health.ConsecutiveFailures)
+	require.False(t, health.LastErrorAt.IsZero())
+}
+
+func TestScheduler(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	s := &scheduler{backoff: BackoffPolicy{Base: time.Second, Max: 4 * time.Second}}
+
+	require.True(t, s.due(now))
+	require.True(t, s.health().Healthy)
+
+	tests := []struct {
+		name     string
+		retryAt  time.Time
+		failures int
+	}{
+		{name: "first failure", retryAt: now.Add(time.Second), failures: 1},
+		{name: "second failure", retryAt: now.Add(2 * time.Second), failures: 2},
+		{name: "capped", retryAt: now.Add(4 * time.Second), failures: 3},
+		{name: "stays capped", retryAt: now.Add(4 * time.Second), failures: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retryAt, failures := s.fail(now, 0.99999)
+			require.WithinDuration(t, tt.retryAt, retryAt, time.Millisecond)
+			require.Equal(t, tt.failures, failures)
+			require.False(t, s.due(now))
+			require.True(t, s.due(retryAt))
+			require.False(t, s.health().Healthy)
+		})
+	}
+
+	require.Equal(t, 4, s.succeed(now))
+	require.True(t, s.due(now))
+	require.True(t, s.health().Healthy)
+	require.Equal(t, 0, s.succeed(now))
+}
+
+func TestWorkerPool_MaxInFlight(t *testing.T) {
+	accrualStub := stub.NewServer()
+	accrualStub.SetLatency(20 * time.Millisecond)
+	accrualStub.Default(stub.Processed(100))
+
+	srv := httptest.NewServer(accrualStub.Handler())
+	defer srv.Close()
+
+	ctx := context.Background()
+	storage := memory.NewStorage()
+	require.NoError(t, storage.Create(ctx, model.User{Login: "gopher", Password: "hash"}))
+
+	numbers := []string{"79927398713", "12345678903", "4561261212345467", "2377225624"}
+	for _, number := range numbers {
+		require.NoError(t, storage.UpdateOrder(ctx, "gopher", model.Order{Number: number}))
+	}
+
+	client, err := accrual.NewClient(srv.URL, "", srv.Client(), time.Second, nil)
+	require.NoError(t, err)
+
+	config := DefaultConfig()
+	config.Size = 4
+	config.MaxInFlight = 2
+	config.PollInterval = 5 * time.Millisecond
+
+	wp := NewWorkerPool(config, client, storage)
+	wp.Run(ctx)
+	defer func() { require.NoError(t, wp.Shutdown(context.Background())) }()
+
+	processed := func() bool {
+		orders, err := storage.GetOrders(ctx, "gopher")
+		require.NoError(t, err)
+		for _, order := range orders {
+			if order.Status != model.OrderStatusProcessed {
+				return false
+			}
+		}
+		return true
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !processed() {
+		require.True(t, time.Now().Before(deadline), "orders weren't processed in time")
+		require.LessOrEqual(t, wp.Health().InFlight, int64(2))
+		time.Sleep(time.Millisecond)
+	}
+
+	require.Eventually(t, func() bool { return wp.Health().InFlight == 0 }, 5*time.Second, time.Millisecond)
+}